@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var conventionalCommitRe = regexp.MustCompile(`^(?P<Type>[a-zA-Z]+)(?:\((?P<Scope>[^)]*)\))?(?P<Breaking>!)?:\s*(?P<Subject>.+)$`)
+
+var changelogSections = []struct {
+	commitType string
+	title      string
+}{
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance Improvements"},
+	{"revert", "Reverts"},
+}
+
+type ChangelogEntry struct {
+	Type     string
+	Scope    string
+	Subject  string
+	Breaking bool
+	Hash     plumbing.Hash
+}
+
+func (entry ChangelogEntry) String() string {
+	line := entry.Subject
+	if entry.Scope != "" {
+		line = fmt.Sprintf("**%s:** %s", entry.Scope, line)
+	}
+	if entry.Breaking {
+		line = "**BREAKING** " + line
+	}
+	return fmt.Sprintf("- %s (%s)", line, entry.Hash.String()[:7])
+}
+
+func parseChangelogEntry(commit *object.Commit) ChangelogEntry {
+	subject := strings.TrimSpace(strings.SplitN(commit.Message, "\n", 2)[0])
+	matches := conventionalCommitRe.FindStringSubmatch(subject)
+	if matches == nil {
+		return ChangelogEntry{Subject: subject, Hash: commit.Hash}
+	}
+	return ChangelogEntry{
+		Type:     strings.ToLower(matches[1]),
+		Scope:    matches[2],
+		Breaking: matches[3] != "" || strings.Contains(commit.Message, "BREAKING CHANGE"),
+		Subject:  matches[4],
+		Hash:     commit.Hash,
+	}
+}
+
+// gitCommitsSinceLastTag returns the commits of HEAD that are not part of the latest version tag,
+// the tag sits on a release branch so the history is compared instead of walking HEAD until the tag
+func gitCommitsSinceLastTag(repo *git.Repository) ([]*object.Commit, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	released := make(map[plumbing.Hash]bool)
+	tagName, tagCommit, err := gitLatestVersionTag(repo)
+	if err != nil {
+		return nil, err
+	}
+	if tagCommit != nil {
+		log.Infof("Generating changelog since %s", tagName)
+		iter, err := repo.Log(&git.LogOptions{From: tagCommit.Hash})
+		if err != nil {
+			return nil, err
+		}
+		if err := iter.ForEach(func(commit *object.Commit) error {
+			released[commit.Hash] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Infof("No version tag found, generating changelog from the whole history")
+	}
+
+	iter, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return nil, err
+	}
+	var commits []*object.Commit
+	err = iter.ForEach(func(commit *object.Commit) error {
+		if !released[commit.Hash] {
+			commits = append(commits, commit)
+		}
+		return nil
+	})
+	return commits, err
+}
+
+func renderChangelog(title string, commits []*object.Commit) string {
+	grouped := make(map[string][]ChangelogEntry)
+	var other []ChangelogEntry
+	for _, commit := range commits {
+		// version bump commits of previous runs
+		if strings.HasPrefix(commit.Message, "[skip ci]") || len(commit.ParentHashes) > 1 {
+			continue
+		}
+		entry := parseChangelogEntry(commit)
+		known := false
+		for _, section := range changelogSections {
+			if entry.Type == section.commitType {
+				grouped[section.title] = append(grouped[section.title], entry)
+				known = true
+			}
+		}
+		if !known {
+			other = append(other, entry)
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("## %s\n", title))
+	writeSection := func(title string, entries []ChangelogEntry) {
+		if len(entries) == 0 {
+			return
+		}
+		out.WriteString(fmt.Sprintf("\n### %s\n\n", title))
+		for _, entry := range entries {
+			out.WriteString(entry.String() + "\n")
+		}
+	}
+	for _, section := range changelogSections {
+		writeSection(section.title, grouped[section.title])
+	}
+	writeSection("Other Changes", other)
+	if len(grouped) == 0 && len(other) == 0 {
+		out.WriteString("\nNo changes\n")
+	}
+	return out.String()
+}
+
+func generateChangelog(repo *git.Repository, cfg *Config, title string) error {
+	commits, err := gitCommitsSinceLastTag(repo)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to read history: %v", err))
+	}
+	changelog := renderChangelog(title, commits)
+	if cfg.DryRun {
+		log.Warnf("Dry run: not writing %s", cfg.ChangelogPath)
+		log.Printf("%s", changelog)
+		return nil
+	}
+	return ioutil.WriteFile(cfg.sourcePath(cfg.ChangelogPath), []byte(changelog), 0644)
+}
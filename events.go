@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type LogEvent struct {
+	Level string `json:"level"`
+	Step  string `json:"step"`
+	Msg   string `json:"msg"`
+}
+
+var jsonLogging bool
+
+func logEvent(level string, step string, format string, args ...interface{}) {
+	if !jsonLogging {
+		return
+	}
+	b, _ := json.Marshal(LogEvent{Level: level, Step: step, Msg: fmt.Sprintf(format, args...)})
+	fmt.Println(string(b))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// githubAppToken caches the installation token for the duration of the run
+var githubAppToken string
+
+func githubAppJwt(appId string, privateKey string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return "", errors.New("github app private key is not PEM encoded")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("unable to parse github app private key: %v", err))
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.New("github app private key is not an RSA key")
+		}
+		key = rsaKey
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	// backdated to allow for clock drift, GitHub accepts at most 10 minutes of validity
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appId,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func githubAppInstallationToken(cfg *Config) (string, error) {
+	if githubAppToken != "" {
+		return githubAppToken, nil
+	}
+	host, _, err := repoHostAndPath(cfg.CloneUrl)
+	if err != nil {
+		return "", err
+	}
+	apiUrl, ok := githubApiUrl(host)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("%s is not a GitHub host", host))
+	}
+	jwt, err := githubAppJwt(cfg.GithubAppId, strings.TrimSpace(string(cfg.GithubAppPrivateKey)), time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", jwt))
+	header.Set("Accept", "application/vnd.github.v3+json")
+	var result struct {
+		Token   string `json:"token"`
+		Message string `json:"message"`
+	}
+	status, err := postJSON(fmt.Sprintf("%s/app/installations/%s/access_tokens", apiUrl, cfg.GithubAppInstallationId), header, map[string]string{}, &result)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("unable to create installation token: %v\n", err))
+	}
+	if status != http.StatusCreated {
+		return "", errors.New(fmt.Sprintf("unable to create installation token, GitHub responded with %d: %s\n", status, result.Message))
+	}
+	githubAppToken = result.Token
+	return githubAppToken, nil
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"github.com/bitrise-io/go-steputils/stepconf"
+	"github.com/bitrise-io/go-utils/log"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -11,32 +15,406 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/openpgp"
+	cryptossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 )
 
-func gitCloneMaster(url string, path string, auth transport.AuthMethod) (*git.Repository, error) {
-	repo, err := git.PlainClone(path, false, &git.CloneOptions{
-		URL:           url,
-		Auth:          auth,
-		ReferenceName: "refs/heads/master",
-		Progress:      os.Stdout,
-		Tags:          git.AllTags,
+var networkTimeout time.Duration
+
+func withNetworkTimeout(fn func(ctx context.Context) error) error {
+	ctx := context.Background()
+	if networkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, networkTimeout)
+		defer cancel()
+	}
+	err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.New(fmt.Sprintf("network operation timed out after %s", networkTimeout))
+	}
+	return err
+}
+
+// gitListRemote runs remote.List, which has no context variant, in the background so that it can time out
+func gitListRemote(remote *git.Remote, auth transport.AuthMethod) ([]*plumbing.Reference, error) {
+	type listResult struct {
+		refs []*plumbing.Reference
+		err  error
+	}
+	var refs []*plumbing.Reference
+	err := withNetworkTimeout(func(ctx context.Context) error {
+		done := make(chan listResult, 1)
+		go func() {
+			refs, err := remote.List(&git.ListOptions{Auth: auth})
+			done <- listResult{refs, err}
+		}()
+		select {
+		case result := <-done:
+			refs = result.refs
+			return result.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return refs, err
+}
+
+func cloneTagMode(value string) git.TagMode {
+	switch value {
+	case "none":
+		return git.NoTags
+	case "following":
+		return git.TagFollowing
+	default:
+		return git.AllTags
+	}
+}
+
+func gitCloneBranch(url string, path string, auth transport.AuthMethod, branch string, depth int, tags git.TagMode, retries int) (*git.Repository, error) {
+	var repo *git.Repository
+	existing, err := dirEntryNames(path)
+	if err != nil {
+		return nil, err
+	}
+	attempt := 0
+	err = withRetry(retries, "clone", isRetryableCloneError, func() error {
+		attempt++
+		log.Printf("Cloning %s (%s), attempt %d/%d", url, branch, attempt, retries+1)
+		err := withNetworkTimeout(func(ctx context.Context) error {
+			var err error
+			repo, err = git.PlainCloneContext(ctx, path, false, &git.CloneOptions{
+				URL:           url,
+				Auth:          auth,
+				ReferenceName: gitRefName(branch),
+				Depth:         depth,
+				Progress:      os.Stdout,
+				Tags:          tags,
+			})
+			return err
+		})
+		if err != nil && err != git.ErrRepositoryAlreadyExists {
+			// PlainClone only cleans up empty directories, a retry would find the repository left behind
+			if err := removeCreatedEntries(path, existing); err != nil {
+				return errors.New(fmt.Sprintf("unable to clean up %s: %v\n", path, err))
+			}
+		}
+		return err
 	})
 	return repo, err
 }
 
+func isRetryableCloneError(err error) bool {
+	switch err {
+	case git.ErrRepositoryAlreadyExists, plumbing.ErrReferenceNotFound, transport.ErrEmptyRemoteRepository,
+		transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed,
+		transport.ErrInvalidAuthMethod, transport.ErrRepositoryNotFound:
+		return false
+	}
+	// a missing base branch is not going to appear on a retry
+	return !strings.Contains(err.Error(), "couldn't find remote ref")
+}
+
+// dirEntryNames lists the entries of dir, a missing dir has none
+func dirEntryNames(dir string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	return names, nil
+}
+
+// removeCreatedEntries removes what a failed clone left in dir and keeps the entries that were there before it.
+// The directory itself is kept, it may be the working directory of the step.
+func removeCreatedEntries(dir string, existing map[string]bool) error {
+	entries, err := dirEntryNames(dir)
+	if err != nil {
+		return err
+	}
+	for name := range entries {
+		if existing[name] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitOpenWorktree opens an already cloned repository instead of cloning it and checks out the base branch,
+// its origin remote has to point to url. Uncommitted changes would end up in the version bump commit,
+// so they are only accepted with allowDirty. The checkout is left untouched unless both checks pass.
+func gitOpenWorktree(path string, branch string, url string, allowDirty bool) (*git.Repository, error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s is not a git repository: %v", path, err))
+	}
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s has no %s remote: %v", path, git.DefaultRemoteName, err))
+	}
+	if urls := remote.Config().URLs; len(urls) > 0 && normalizeRemoteUrl(urls[0]) != normalizeRemoteUrl(url) {
+		return nil, errors.New(fmt.Sprintf("remote %s of %s is %s instead of %s", git.DefaultRemoteName, path, urls[0], url))
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, err
+	}
+	if !status.IsClean() {
+		if !allowDirty {
+			return nil, errors.New(fmt.Sprintf("%s has uncommitted changes that would be committed with the version bump, commit them or set commit_paths", path))
+		}
+		log.Warnf("%s has uncommitted changes, only commit_paths are committed with the version bump", path)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read HEAD of %s: %v", path, err))
+	}
+	if head.Name() != gitRefName(branch) {
+		log.Infof("%s has %s checked out, checking out the base branch %s", path, head.Name().Short(), branch)
+		if err := gitCheckoutBranch(repo, branch); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+func normalizeRemoteUrl(url string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+}
+
+// gitCloneWithReference clones from a local mirror of the remote and then only fetches what the mirror is missing,
+// go-git has no support for alternates so the objects of the mirror are copied instead of being shared
+func gitCloneWithReference(url string, path string, auth transport.AuthMethod, branch string, referencePath string, tags git.TagMode) (*git.Repository, error) {
+	if _, err := git.PlainOpen(referencePath); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s is not a git repository: %v", referencePath, err))
+	}
+	repo, err := git.PlainClone(path, false, &git.CloneOptions{
+		URL:        referencePath,
+		NoCheckout: true,
+		Tags:       tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.DeleteRemote(git.DefaultRemoteName); err != nil {
+		return nil, err
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+	}); err != nil {
+		return nil, err
+	}
+
+	remoteRef := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch)
+	err = withNetworkTimeout(func(ctx context.Context) error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: git.DefaultRemoteName,
+			RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", gitRefName(branch), remoteRef))},
+			Auth:       auth,
+			Progress:   os.Stdout,
+			Tags:       tags,
+		})
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+	ref, err := repo.Reference(remoteRef, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// the clone already created the default branch of the mirror, which may be stale or a different branch
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(gitRefName(branch), ref.Hash())); err != nil {
+		return nil, err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	err = worktree.Checkout(&git.CheckoutOptions{
+		Branch: gitRefName(branch),
+		Force:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
 func gitRefName(name string) plumbing.ReferenceName {
 	return plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", name))
 }
 
-func gitCheckoutBranch(repo *git.Repository, branchName string) {
+const invalidRefChars = " ~^:?*[\\"
+
+// sanitizeBranchName checks name against the rules of git check-ref-format, with mode "replace"
+// the offending characters are replaced by "-" instead of being rejected
+func sanitizeBranchName(name string, mode string) (string, error) {
+	if mode == "replace" {
+		name = strings.Map(func(r rune) rune {
+			if r < 32 || r == 127 || strings.ContainsRune(invalidRefChars, r) {
+				return '-'
+			}
+			return r
+		}, name)
+		name = strings.ReplaceAll(name, "@{", "-{")
+		for strings.Contains(name, "..") {
+			name = strings.ReplaceAll(name, "..", ".")
+		}
+		for strings.Contains(name, "//") {
+			name = strings.ReplaceAll(name, "//", "/")
+		}
+		components := strings.Split(strings.Trim(name, "/"), "/")
+		for i, component := range components {
+			components[i] = strings.TrimSuffix(strings.TrimLeft(component, "."), ".lock")
+		}
+		name = strings.TrimRight(strings.Join(components, "/"), ".")
+	}
+
+	var offending []string
+	for _, r := range name {
+		if r < 32 || r == 127 || strings.ContainsRune(invalidRefChars, r) {
+			if r == ' ' {
+				offending = append(offending, "space")
+			} else {
+				offending = append(offending, fmt.Sprintf("%q", r))
+			}
+		}
+	}
+	if strings.Contains(name, "..") {
+		offending = append(offending, `".."`)
+	}
+	if strings.Contains(name, "@{") {
+		offending = append(offending, `"@{"`)
+	}
+	if strings.Contains(name, "//") {
+		offending = append(offending, `"//"`)
+	}
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		offending = append(offending, "leading or trailing \"/\"")
+	}
+	if strings.HasSuffix(name, ".") {
+		offending = append(offending, "trailing \".\"")
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			offending = append(offending, fmt.Sprintf("path component %q starting with \".\" or ending with \".lock\"", component))
+		}
+	}
+	if name == "" || name == "@" {
+		offending = append(offending, fmt.Sprintf("name %q", name))
+	}
+	if len(offending) > 0 {
+		return "", errors.New(fmt.Sprintf("invalid release branch name %q: %s\n", name, strings.Join(offending, ", ")))
+	}
+	return name, nil
+}
+
+func gitRemoteBranchExists(repo *git.Repository, auth transport.AuthMethod, branchName string) (bool, error) {
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return false, err
+	}
+	refs, err := gitListRemote(remote, auth)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("unable to list remote branches: %v\n", err))
+	}
+	for _, ref := range refs {
+		if ref.Name() == gitRefName(branchName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var commitShaRe = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+func isCommitSha(ref string) bool {
+	return commitShaRe.MatchString(ref)
+}
+
+func gitResolveCommit(repo *git.Repository, sha string) (plumbing.Hash, error) {
+	if !isCommitSha(sha) {
+		return plumbing.ZeroHash, errors.New(fmt.Sprintf("%s is not a commit sha\n", sha))
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(sha))
+	if err != nil {
+		return plumbing.ZeroHash, errors.New(fmt.Sprintf("unable to resolve commit %s: %v\n", sha, err))
+	}
+	if _, err := repo.CommitObject(*hash); err != nil {
+		return plumbing.ZeroHash, errors.New(fmt.Sprintf("%s does not point to a commit: %v\n", sha, err))
+	}
+	return *hash, nil
+}
+
+func gitResolveTag(repo *git.Repository, tagName string) (plumbing.Hash, error) {
+	ref, err := repo.Tag(tagName)
+	if err == git.ErrTagNotFound {
+		return plumbing.ZeroHash, errors.New(fmt.Sprintf("tag %s does not exist, make sure it is pushed and clone_tags is not none\n", tagName))
+	}
+	if err != nil {
+		return plumbing.ZeroHash, errors.New(fmt.Sprintf("unable to resolve tag %s: %v\n", tagName, err))
+	}
+	// annotated tags point to a tag object, lightweight tags directly to the commit
+	if tag, err := repo.TagObject(ref.Hash()); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, errors.New(fmt.Sprintf("tag %s does not point to a commit: %v\n", tagName, err))
+		}
+		return commit.Hash, nil
+	}
+	if _, err := repo.CommitObject(ref.Hash()); err != nil {
+		return plumbing.ZeroHash, errors.New(fmt.Sprintf("tag %s does not point to a commit: %v\n", tagName, err))
+	}
+	return ref.Hash(), nil
+}
+
+func gitCheckoutBranch(repo *git.Repository, branchName string) error {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
 	branch := gitRefName(branchName)
-	wt, _ := repo.Worktree()
-	_ = wt.Checkout(&git.CheckoutOptions{
-		Branch: branch,
-	})
+	opts := &git.CheckoutOptions{Branch: branch}
+	if _, err := repo.Reference(branch, true); err == plumbing.ErrReferenceNotFound {
+		// after a clone only the cloned branch exists locally, create a tracking branch like `git checkout -b name origin/name`
+		remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branchName), true)
+		if err != nil {
+			return errors.New(fmt.Sprintf("branch %s exists neither locally nor on %s\n", branchName, git.DefaultRemoteName))
+		}
+		if err := repo.CreateBranch(&config.Branch{
+			Name:   branchName,
+			Remote: git.DefaultRemoteName,
+			Merge:  branch,
+		}); err != nil && err != git.ErrBranchExists {
+			return errors.New(fmt.Sprintf("unable to configure tracking branch %s: %v\n", branchName, err))
+		}
+		opts.Hash = remoteRef.Hash()
+		opts.Create = true
+	}
+	if err := wt.Checkout(opts); err != nil {
+		return errors.New(fmt.Sprintf("unable to checkout branch %s: %v\n", branchName, err))
+	}
+	return nil
 }
 
 func gitAddAll(repo *git.Repository) error {
@@ -48,116 +426,733 @@ func gitAddAll(repo *git.Repository) error {
 	return nil
 }
 
-func gitCommit(repo *git.Repository, commitMsg string) error {
-	wt, _ := repo.Worktree()
-	_, err := wt.Commit(commitMsg, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "Bitrise",
-			Email: "bitrise@bitrise.io",
-			When:  time.Now(),
-		},
-	})
+func gitAddPaths(repo *git.Repository, globs []string) error {
+	wt, err := repo.Worktree()
 	if err != nil {
 		return err
 	}
+	for _, glob := range globs {
+		if err := wt.AddGlob(glob); err != nil {
+			return errors.New(fmt.Sprintf("unable to stage %s: %v", glob, err))
+		}
+	}
 	return nil
 }
 
-func gitTag(repo *git.Repository, tagName string) error {
-	head, _ := repo.Head()
+// gitHasStagedChanges reports whether the index differs from HEAD, unstaged and untracked files are ignored
+func gitHasStagedChanges(repo *git.Repository) (bool, error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return false, err
+	}
+	for _, fileStatus := range status {
+		if fileStatus.Staging != git.Unmodified && fileStatus.Staging != git.Untracked {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func gitCommit(repo *git.Repository, commitMsg string, signature *object.Signature, signKey *openpgp.Entity) (plumbing.Hash, error) {
+	wt, _ := repo.Worktree()
+	hash, err := wt.Commit(commitMsg, &git.CommitOptions{
+		Author:    signature,
+		Committer: signature,
+		SignKey:   signKey,
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return hash, nil
+}
+
+// gitHead resolves HEAD, which is either a branch or a detached commit, a repository without commits has no HEAD
+func gitHead(repo *git.Repository) (*plumbing.Reference, error) {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, errors.New("unable to resolve HEAD, the repository has no commits\n")
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to resolve HEAD: %v\n", err))
+	}
+	return head, nil
+}
+
+func gitTag(repo *git.Repository, tagName string, opts *git.CreateTagOptions) error {
+	head, err := gitHead(repo)
+	if err != nil {
+		return err
+	}
 	_, _ = fmt.Fprintf(os.Stdout, "Attempting to tag HEAD with: %s\n", tagName)
-	_, err := repo.CreateTag(tagName, head.Hash(), nil)
+	_, err = repo.CreateTag(tagName, head.Hash(), opts)
 
+	if err == git.ErrTagExists {
+		return err
+	}
 	if err != nil {
 		return errors.New(fmt.Sprintf("error creating tag: %v\n", err))
 	}
+	logEvent("info", "tag", "Created tag %s at %s", tagName, head.Hash())
 	return nil
 }
 
-func gitPushTag(repo *git.Repository, auth transport.AuthMethod, tagName string) error {
-	refSpec := config.RefSpec("refs/tags/*:refs/tags/*")
-	if tagName != "" {
-		refSpec = config.RefSpec(fmt.Sprintf("refs/tags/%[1]s:refs/tags/%[1]s", tagName))
+func gitPush(repo *git.Repository, auth transport.AuthMethod, cfg *Config, refSpecs ...config.RefSpec) error {
+	return gitPushToRemote(repo, git.DefaultRemoteName, auth, cfg, refSpecs...)
+}
+
+func gitPushToRemote(repo *git.Repository, remoteName string, auth transport.AuthMethod, cfg *Config, refSpecs ...config.RefSpec) error {
+	if cfg.DryRun {
+		for _, refSpec := range refSpecs {
+			log.Warnf("Dry run: skipping push of %s to %s", refSpec, remoteName)
+		}
+		return nil
 	}
 	opts := git.PushOptions{
-		RefSpecs: []config.RefSpec{refSpec},
-		Progress: os.Stdout,
-		Auth:     auth,
+		RemoteName: remoteName,
+		RefSpecs:   refSpecs,
+		Progress:   os.Stdout,
+		Auth:       auth,
+	}
+	err := withRetry(cfg.PushRetries, "push", isRetryablePushError, func() error {
+		return withNetworkTimeout(func(ctx context.Context) error {
+			return repo.PushContext(ctx, &opts)
+		})
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		logEvent("error", "push", "Push of %v failed: %v", refSpecs, err)
+		return err
+	}
+	logEvent("info", "push", "Pushed %v", refSpecs)
+	return nil
+}
+
+func withRetry(retries int, action string, retryable func(error) bool, fn func() error) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > retries || !retryable(err) {
+			return err
+		}
+		log.Warnf("Attempt %d/%d to %s failed: %v, retrying in %s", attempt, retries+1, action, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isRetryablePushError(err error) bool {
+	switch err {
+	case git.NoErrAlreadyUpToDate, git.ErrForceNeeded,
+		transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed,
+		transport.ErrInvalidAuthMethod, transport.ErrRepositoryNotFound:
+		return false
+	}
+	msg := err.Error()
+	// rejections reported by the remote are not going to change on a retry
+	return !strings.Contains(msg, "non-fast-forward") && !strings.HasPrefix(msg, "command error on")
+}
+
+// gitPushTags returns the tags that were pushed, tags that were created on the remote in the meantime
+// (e.g. by a parallel build) are skipped
+func gitPushTags(repo *git.Repository, remoteName string, auth transport.AuthMethod, cfg *Config, tagNames []string) ([]string, error) {
+	if len(tagNames) == 0 {
+		return nil, nil
 	}
-	err := repo.Push(&opts)
+	var refSpecs []config.RefSpec
+	for _, tagName := range tagNames {
+		refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("refs/tags/%[1]s:refs/tags/%[1]s", tagName)))
+	}
+	err := gitPushToRemote(repo, remoteName, auth, cfg, refSpecs...)
 	if err != nil {
-		if err == git.NoErrAlreadyUpToDate {
-			return nil
+		remoteTags, listErr := gitRemoteTags(repo, remoteName, auth)
+		if listErr == nil {
+			var remaining []string
+			for _, tagName := range tagNames {
+				if remoteTags[tagName] {
+					log.Warnf("Tag %s already exists on %s, skipping", tagName, remoteName)
+				} else {
+					remaining = append(remaining, tagName)
+				}
+			}
+			if len(remaining) < len(tagNames) {
+				return gitPushTags(repo, remoteName, auth, cfg, remaining)
+			}
 		}
-		return err
+
+		// the remote reports the first rejected ref, point at the tag that caused it
+		msg := err.Error()
+		for _, tagName := range tagNames {
+			ref := fmt.Sprintf("refs/tags/%s", tagName)
+			if strings.Contains(msg, ref+":") || strings.HasSuffix(msg, ref) {
+				return nil, errors.New(fmt.Sprintf("unable to push tag %s: %v\n", tagName, err))
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("unable to push tags %s: %v\n", strings.Join(tagNames, ", "), err))
+	}
+	return tagNames, nil
+}
+
+func gitRemoteTags(repo *git.Repository, remoteName string, auth transport.AuthMethod) (map[string]bool, error) {
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := gitListRemote(remote, auth)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]bool)
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags[ref.Name().Short()] = true
+		}
+	}
+	return tags, nil
+}
+
+func gitDeleteRemoteRefs(repo *git.Repository, auth transport.AuthMethod, cfg *Config, refs []plumbing.ReferenceName) error {
+	var refSpecs []config.RefSpec
+	for _, ref := range refs {
+		log.Warnf("Cleaning up: deleting remote %s", ref)
+		refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf(":%s", ref)))
+	}
+	return gitPush(repo, auth, cfg, refSpecs...)
+}
+
+func gitDeleteRemoteBranch(repo *git.Repository, auth transport.AuthMethod, cfg *Config, branchName string) error {
+	if branchName == cfg.BaseBranch || branchName == cfg.BumpTargetBranch {
+		return errors.New(fmt.Sprintf("refusing to delete branch %s\n", branchName))
+	}
+	log.Infof("Deleting remote branch %s", branchName)
+	if err := gitPush(repo, auth, cfg, config.RefSpec(fmt.Sprintf(":%s", gitRefName(branchName)))); err != nil {
+		return errors.New(fmt.Sprintf("unable to delete branch %s: %v\n", branchName, err))
 	}
 	return nil
 }
 
-func gitPushBranch(repo *git.Repository, auth transport.AuthMethod, branchName string) error {
-	refSpec := config.RefSpec(fmt.Sprintf("refs/heads/%[1]s:refs/heads/%[1]s", branchName))
-	opts := git.PushOptions{
-		RefSpecs: []config.RefSpec{refSpec},
-		Progress: os.Stdout,
-		Auth:     auth,
+func gitFetchTags(repo *git.Repository, auth transport.AuthMethod) error {
+	err := withNetworkTimeout(func(ctx context.Context) error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: git.DefaultRemoteName,
+			RefSpecs:   []config.RefSpec{"+refs/tags/*:refs/tags/*"},
+			Auth:       auth,
+			Progress:   os.Stdout,
+			Tags:       git.NoTags,
+		})
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.New(fmt.Sprintf("unable to fetch tags: %v\n", err))
+	}
+	return nil
+}
+
+func gitFetchBranch(repo *git.Repository, auth transport.AuthMethod, remoteName string, localName string) error {
+	err := withNetworkTimeout(func(ctx context.Context) error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: git.DefaultRemoteName,
+			RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", gitRefName(remoteName), gitRefName(localName)))},
+			Auth:       auth,
+			Progress:   os.Stdout,
+			Tags:       git.NoTags,
+		})
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.New(fmt.Sprintf("unable to fetch branch %s: %v\n", remoteName, err))
 	}
-	err := repo.Push(&opts)
+	return nil
+}
+
+func gitLatestVersionTag(repo *git.Repository) (string, *object.Commit, error) {
+	tags, err := repo.Tags()
 	if err != nil {
-		if err == git.NoErrAlreadyUpToDate {
+		return "", nil, err
+	}
+	var latestName string
+	var latest *object.Commit
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		if !tagFileRe.MatchString(ref.Name().Short()) {
 			return nil
 		}
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			hash = tag.Target
+		}
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil
+		}
+		if latest == nil || commit.Committer.When.After(latest.Committer.When) {
+			latestName = ref.Name().Short()
+			latest = commit
+		}
+		return nil
+	})
+	return latestName, latest, err
+}
+
+func gitHasChangesSinceLastTag(repo *git.Repository) (bool, error) {
+	tagName, tagCommit, err := gitLatestVersionTag(repo)
+	if err != nil {
+		return false, err
+	}
+	if tagCommit == nil {
+		log.Infof("No version tag found, treating all commits as changes")
+		return true, nil
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return false, err
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return false, err
+	}
+	// the tag sits on the release branch, HEAD being part of its history means nothing was added since
+	if headCommit.Hash == tagCommit.Hash {
+		log.Infof("HEAD is tagged with %s", tagName)
+		return false, nil
+	}
+	released, err := headCommit.IsAncestor(tagCommit)
+	if err != nil {
+		return false, err
+	}
+	if released {
+		log.Infof("HEAD is already part of %s", tagName)
+	}
+	return !released, nil
+}
+
+type NonFastForwardError struct {
+	Branch string
+	Err    error
+}
+
+func (e *NonFastForwardError) Error() string {
+	return fmt.Sprintf("push of branch %s was rejected because the remote branch contains commits that are not present locally (%v), "+
+		"make sure nothing is pushed to %[1]s while the step runs and re-run it\n", e.Branch, e.Err)
+}
+
+func isNonFastForwardError(err error) bool {
+	msg := err.Error()
+	return err == git.ErrNonFastForwardUpdate || strings.Contains(msg, "non-fast-forward") || strings.Contains(msg, "fetch first")
+}
+
+func gitCreateBranchAtHead(repo *git.Repository, branchName string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(gitRefName(branchName), head.Hash()))
+}
+
+func gitPushBranch(repo *git.Repository, auth transport.AuthMethod, cfg *Config, localName string, remoteName string, force bool) error {
+	refSpec := config.RefSpec(fmt.Sprintf("%s:%s", gitRefName(localName), gitRefName(remoteName)))
+	if force {
+		if remoteName == cfg.BaseBranch {
+			return errors.New(fmt.Sprintf("refusing to force push base branch %s\n", remoteName))
+		}
+		log.Warnf("Force pushing branch %s", remoteName)
+		refSpec = "+" + refSpec
+	}
+	if localName != remoteName {
+		log.Infof("Pushing branch %s as %s", localName, remoteName)
+	}
+	if err := gitPush(repo, auth, cfg, refSpec); err != nil {
+		if isNonFastForwardError(err) {
+			return &NonFastForwardError{Branch: remoteName, Err: err}
+		}
 		return errors.New(fmt.Sprintf("unable to push branch: %v\n", err))
 	}
 	return nil
 }
 
+const tagRemoteName = "tag-mirror"
+
+func gitPushTagsToMirror(repo *git.Repository, cfg *Config, tagNames []string) error {
+	token := cfg.AccessToken
+	if cfg.TagRemoteAccessToken != "" {
+		token = cfg.TagRemoteAccessToken
+	}
+	auth, err := getGitAuthForUrl(cfg, cfg.TagRemoteUrl, token)
+	if err != nil {
+		return err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: tagRemoteName,
+		URLs: []string{cfg.TagRemoteUrl},
+	})
+	if err != nil && err != git.ErrRemoteExists {
+		return errors.New(fmt.Sprintf("unable to add tag remote %s: %v\n", cfg.TagRemoteUrl, err))
+	}
+	log.Infof("Pushing tags to %s", cfg.TagRemoteUrl)
+	_, err = gitPushTags(repo, tagRemoteName, auth, cfg, tagNames)
+	return err
+}
+
 func getGitAuth(cfg *Config) (transport.AuthMethod, error) {
-	if strings.HasPrefix(cfg.CloneUrl, "http") {
+	return getGitAuthForUrl(cfg, cfg.CloneUrl, cfg.AccessToken)
+}
+
+// getPushAuth returns the credentials for pushing when they differ from the ones used for cloning
+func getPushAuth(cfg *Config) (transport.AuthMethod, error) {
+	url := cfg.CloneUrl
+	if cfg.PushUrl != "" {
+		url = cfg.PushUrl
+	}
+	if cfg.PushSSHKeyPath != "" {
+		if strings.HasPrefix(url, "http") {
+			return nil, errors.New(fmt.Sprintf("push_ssh_key_path requires an ssh push url, got %s\n", url))
+		}
+		pushCfg := *cfg
+		pushCfg.SSHPrivateKeyPath = cfg.PushSSHKeyPath
+		// the push key is requested explicitly, it takes precedence over the agent
+		pushCfg.SSHUseAgent = false
+		return getGitAuthForUrl(&pushCfg, url, "")
+	}
+	token := cfg.AccessToken
+	if cfg.PushAccessToken != "" {
+		token = cfg.PushAccessToken
+	}
+	return getGitAuthForUrl(cfg, url, token)
+}
+
+func gitSetRemoteUrl(repo *git.Repository, remoteName string, url string) error {
+	repoConfig, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := repoConfig.Remotes[remoteName]
+	if !ok {
+		return git.ErrRemoteNotFound
+	}
+	remote.URLs = []string{url}
+	return repo.Storer.SetConfig(repoConfig)
+}
+
+func getGitAuthForUrl(cfg *Config, url string, token stepconf.Secret) (transport.AuthMethod, error) {
+	if strings.HasPrefix(url, "http") {
 		auth := &http.BasicAuth{
 			Username: cfg.Username,
-			Password: string(cfg.AccessToken),
+			Password: string(token),
+		}
+		if cfg.NetrcPath != "" {
+			entry, err := netrcCredentials(cfg.NetrcPath, url)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil && entry.Password != "" {
+				if entry.Login != "" {
+					auth.Username = entry.Login
+				}
+				auth.Password = entry.Password
+			}
 		}
 		return auth, nil
 	} else {
-		sshPk, err := ssh.NewPublicKeysFromFile("git", cfg.SSHPrivateKeyPath, "")
+		if cfg.SSHUseAgent {
+			agentAuth, err := ssh.NewSSHAgentAuth("git")
+			if err == nil {
+				if err := setHostKeyCallback(cfg, &agentAuth.HostKeyCallbackHelper); err != nil {
+					return nil, err
+				}
+				return agentAuth, nil
+			}
+			log.Warnf("SSH agent is not available, falling back to the key at %s: %v", cfg.SSHPrivateKeyPath, err)
+		}
+		sshPk, err := loadSSHKey(cfg.SSHPrivateKeyPath, string(cfg.SSHKeyPassphrase))
 		if err != nil {
 			return nil, err
 		}
+		if err := setHostKeyCallback(cfg, &sshPk.HostKeyCallbackHelper); err != nil {
+			return nil, err
+		}
 		return sshPk, err
 	}
 }
 
-func processTagFile(repo *git.Repository, auth transport.AuthMethod, config *Config) error {
-	file, _ := os.OpenFile(config.tagFilePath(), os.O_RDONLY, 0644)
+func loadSignKey(armoredKey string, passphrase string) (*openpgp.Entity, error) {
+	if armoredKey == "" {
+		return nil, nil
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredKey))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read gpg private key: %v\n", err))
+	}
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, errors.New("gpg key does not contain a private key\n")
+	}
+	entity := entities[0]
+	if entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to decrypt gpg private key: %v\n", err))
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, errors.New(fmt.Sprintf("unable to decrypt gpg private subkey: %v\n", err))
+			}
+		}
+	}
+	return entity, nil
+}
+
+// setHostKeyCallback configures how the identity of the SSH server is verified.
+// Skipping the verification makes the connection open to man-in-the-middle attacks where the pushed
+// credentials and commits can be intercepted, so it is only done when explicitly requested. Without
+// a known_hosts file go-git falls back to the default ~/.ssh/known_hosts and SSH_KNOWN_HOSTS files.
+func setHostKeyCallback(cfg *Config, sshPk *ssh.HostKeyCallbackHelper) error {
+	if cfg.InsecureIgnoreHostKey {
+		log.Warnf("SSH host key verification is disabled")
+		sshPk.HostKeyCallback = cryptossh.InsecureIgnoreHostKey()
+		return nil
+	}
+	if cfg.SSHKnownHostsFile == "" {
+		return nil
+	}
+	callback, err := ssh.NewKnownHostsCallback(cfg.SSHKnownHostsFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to load known hosts file %s: %v\n", cfg.SSHKnownHostsFile, err))
+	}
+	sshPk.HostKeyCallback = callback
+	return nil
+}
+
+func loadSSHKey(path string, passphrase string) (*ssh.PublicKeys, error) {
+	if path == "" {
+		return nil, errors.New("ssh_key_save_path is required for ssh remotes\n")
+	}
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New(fmt.Sprintf("ssh private key not found at %s\n", path))
+		}
+		return nil, errors.New(fmt.Sprintf("unable to read ssh private key %s: %v\n", path, err))
+	}
+
+	sshPk, err := ssh.NewPublicKeys("git", pemBytes, passphrase)
+	if _, ok := err.(*cryptossh.PassphraseMissingError); ok && passphrase != "" {
+		// go-git only decrypts legacy PEM keys, OpenSSH formatted keys are decrypted here
+		var signer cryptossh.Signer
+		signer, err = cryptossh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+		if err == nil {
+			sshPk = &ssh.PublicKeys{User: "git", Signer: signer}
+		}
+	}
+	if err != nil {
+		switch err.(type) {
+		case *cryptossh.PassphraseMissingError:
+			return nil, errors.New(fmt.Sprintf("ssh private key %s is encrypted but no passphrase was given\n", path))
+		}
+		if err == x509.IncorrectPasswordError {
+			return nil, errors.New(fmt.Sprintf("wrong passphrase for ssh private key %s\n", path))
+		}
+		return nil, errors.New(fmt.Sprintf("unable to load ssh private key %s: %v\n", path, err))
+	}
+	return sshPk, nil
+}
+
+// processTagFile creates and pushes the tags of the tag file and returns the ones pushed to origin,
+// also when pushing them to tag_remote_url fails afterwards so that they can be cleaned up
+func processTagFile(repo *git.Repository, auth transport.AuthMethod, config *Config, signKey *openpgp.Entity, path string, versions TagFileVersions) ([]string, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to open tag file %s: %v", path, err))
+	}
 	defer file.Close()
 	reader := bufio.NewScanner(file)
 
 	var tags []string
 	var tagsToPush []string
+	messages := make(map[string]string)
+	versionNames := make(map[string]string)
 
+	now := time.Now()
+	section := ""
 	for reader.Scan() {
 		line := strings.TrimSpace(reader.Text())
-		if !strings.HasPrefix(line, "#") && line != "" {
-			tags = append(tags, line)
+		if !config.isTagFileComment(line) && line != "" {
+			_, section, line = splitTagSection(line, section)
+			if line == "" {
+				continue
+			}
+			name, message := splitTagLine(line)
+			if isTagTemplateLine(name) {
+				version := versions[section]
+				if version == nil {
+					return nil, errors.New(fmt.Sprintf("no bumped version to render tag template: %s\n", name))
+				}
+				rendered, err := renderTemplate(config, "tagLine", name, *version)
+				if err != nil {
+					return nil, err
+				}
+				name = rendered
+			}
+			tag, err := tagWithSuffix(config, name, now)
+			if err != nil {
+				return nil, err
+			}
+			tag = config.TagNamePrefix + tag
+			if section != "" {
+				tag = section + "-" + tag
+			}
+			tag = config.namespacedTag(tag)
+			tags = append(tags, tag)
+			messages[tag] = message
+			versionNames[tag] = name
 		}
 	}
 	if len(tags) == 0 {
-		return nil
+		return nil, nil
+	}
+	var includeRe, pushFilterRe *regexp.Regexp
+	if config.TagInclude != "" {
+		includeRe = regexp.MustCompile(config.TagInclude)
+	}
+	if config.TagPushFilter != "" {
+		pushFilterRe = regexp.MustCompile(config.TagPushFilter)
 	}
 	for _, tag := range tags {
-		if err := gitTag(repo, tag); err != nil {
+		if includeRe != nil && !includeRe.MatchString(tag) {
+			log.Printf("Skipping tag %s, it does not match tag_include", tag)
+			summary.addTag(tag, "skipped, not included")
+			continue
+		}
+		opts, err := tagOptions(config, tag, versionNames[tag], messages[tag], signKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := gitTag(repo, tag, opts); err != nil {
 			if err == git.ErrTagExists {
 				fmt.Fprintf(os.Stderr, "WARN: tag %s already exists in local! Skipipng\n", tag)
-			} else {
-				return err
+				summary.addTag(tag, "skipped, already exists locally")
+				continue
 			}
+			return nil, err
+		}
+		if pushFilterRe != nil && pushFilterRe.MatchString(tag) {
+			log.Printf("Not pushing tag %s, it matches tag_push_filter", tag)
+			summary.addTag(tag, "created locally, not pushed")
+			continue
 		}
 		tagsToPush = append(tagsToPush, tag)
 	}
-	for _, tagToPush := range tagsToPush {
-		if err := gitPushTag(repo, auth, tagToPush); err != nil {
-			return err
+	pushedTags, err := gitPushTags(repo, git.DefaultRemoteName, auth, config, tagsToPush)
+	if err != nil {
+		return nil, err
+	}
+	pushed := make(map[string]bool)
+	for _, tag := range pushedTags {
+		pushed[tag] = true
+	}
+	for _, tag := range tagsToPush {
+		switch {
+		case !pushed[tag]:
+			summary.addTag(tag, "skipped, already exists on remote")
+		case config.DryRun:
+			summary.addTag(tag, "created, not pushed (dry run)")
+		default:
+			summary.addTag(tag, "created")
 		}
 	}
-	return nil
+	if config.TagRemoteUrl != "" {
+		if err := gitPushTagsToMirror(repo, config, tagsToPush); err != nil {
+			return pushedTags, err
+		}
+	}
+	return pushedTags, nil
+}
+
+// namespacedTag places the tag under tag_namespace, e.g. refs/tags/mobile/1.2.3 for the namespace mobile
+func (cfg *Config) namespacedTag(tag string) string {
+	namespace := strings.Trim(cfg.TagNamespace, "/")
+	if namespace == "" {
+		return tag
+	}
+	return namespace + "/" + tag
+}
+
+func splitTagLine(line string) (string, string) {
+	// template pipelines also use "|", only split after the last action
+	offset := strings.LastIndex(line, "}}") + 1
+	index := strings.Index(line[offset:], "|")
+	if index < 0 {
+		return line, ""
+	}
+	return strings.TrimSpace(line[:offset+index]), strings.TrimSpace(line[offset+index+1:])
+}
+
+func tagOptions(config *Config, tagName string, version string, message string, signKey *openpgp.Entity) (*git.CreateTagOptions, error) {
+	if config.TagType == "lightweight" {
+		if message != "" {
+			log.Warnf("Ignoring the message of tag %s, tag_type is lightweight", tagName)
+		}
+		return nil, nil
+	}
+	if message != "" {
+		return &git.CreateTagOptions{
+			Tagger:  config.signature(time.Now()),
+			Message: message,
+			SignKey: signKey,
+		}, nil
+	}
+	if config.TagMessageTemplate == "" {
+		if config.TagType == "annotated" {
+			return &git.CreateTagOptions{
+				Tagger:  config.signature(time.Now()),
+				Message: fmt.Sprintf("Release %s", tagName),
+				SignKey: signKey,
+			}, nil
+		}
+		if signKey == nil {
+			return nil, nil
+		}
+		// only annotated tags can be signed
+		return &git.CreateTagOptions{
+			Tagger:  config.signature(time.Now()),
+			Message: tagName,
+			SignKey: signKey,
+		}, nil
+	}
+	semver, err := parseTagVersion(config, version)
+	if err != nil {
+		return nil, err
+	}
+	message, err = renderTemplate(config, "tagMessage", config.TagMessageTemplate, semver)
+	if err != nil {
+		return nil, err
+	}
+	return &git.CreateTagOptions{
+		Tagger:  config.signature(time.Now()),
+		Message: message,
+		SignKey: signKey,
+	}, nil
+}
+
+type TagSuffixContext struct {
+	Semver
+	time.Time
+	Week int
+}
+
+func tagWithSuffix(config *Config, tag string, now time.Time) (string, error) {
+	if config.TagNameSuffix == "" {
+		return tag, nil
+	}
+	if !strings.Contains(config.TagNameSuffix, "{{") {
+		return tag + config.TagNameSuffix, nil
+	}
+	semver, err := parseTagVersion(config, tag)
+	if err != nil {
+		return "", err
+	}
+	_, week := now.ISOWeek()
+	suffix, err := renderTemplate(config, "tagSuffix", config.TagNameSuffix, TagSuffixContext{Semver: semver, Time: now, Week: week})
+	if err != nil {
+		return "", err
+	}
+	return tag + suffix, nil
 }
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func testSignature() *object.Signature {
+	return &object.Signature{Name: "Release Bot", Email: "release@example.com", When: time.Date(2021, time.March, 4, 10, 0, 0, 0, time.UTC)}
+}
+
+// initTestRepo creates a repository on the master branch with a single commit of the given files
+func initTestRepo(t *testing.T, files map[string]string) (string, *git.Repository) {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitTestFiles(t, repo, dir, files, "initial commit")
+	return dir, repo
+}
+
+func commitTestFiles(t *testing.T, repo *git.Repository, dir string, files map[string]string, msg string) plumbing.Hash {
+	t.Helper()
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+	if err := gitAddAll(repo); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := gitCommit(repo, msg, testSignature(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitCloneBranchRetryKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "keep.txt"), "keep")
+
+	_, err := gitCloneBranch("http://127.0.0.1:1/repo.git", dir, nil, "master", 0, git.NoTags, 1)
+	if err == nil {
+		t.Fatal("expected the clone to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep.txt")); err != nil {
+		t.Errorf("keep.txt was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); !os.IsNotExist(err) {
+		t.Errorf("expected the failed clone to be cleaned up, got %v", err)
+	}
+}
+
+func TestRemoveCreatedEntries(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "keep.txt"), "keep")
+	existing, err := dirEntryNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/master")
+	writeTestFile(t, filepath.Join(dir, "checked-out.txt"), "partial")
+
+	if err := removeCreatedEntries(dir, existing); err != nil {
+		t.Fatal(err)
+	}
+	names, err := dirEntryNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || !names["keep.txt"] {
+		t.Errorf("expected only keep.txt to be left, got %v", names)
+	}
+}
+
+// initTestRemote creates a repository with a master and a develop branch, develop is one commit ahead
+func initTestRemote(t *testing.T) (string, plumbing.Hash) {
+	t.Helper()
+	dir, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: gitRefName("develop"), Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	develop := commitTestFiles(t, repo, dir, map[string]string{"develop.txt": "develop"}, "develop commit")
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: gitRefName("master")}); err != nil {
+		t.Fatal(err)
+	}
+	return dir, develop
+}
+
+func TestGitCheckoutBranchAfterClone(t *testing.T) {
+	remote, develop := initTestRemote(t)
+	repo, err := gitCloneBranch(remote, t.TempDir(), nil, "master", 0, git.NoTags, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Reference(gitRefName("develop"), true); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("expected develop to only exist on the remote, got %v", err)
+	}
+
+	if err := gitCheckoutBranch(repo, "develop"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name() != gitRefName("develop") || head.Hash() != develop {
+		t.Errorf("expected develop at %s, got %s at %s", develop, head.Name(), head.Hash())
+	}
+	branch, err := repo.Branch("develop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch.Remote != git.DefaultRemoteName || branch.Merge != gitRefName("develop") {
+		t.Errorf("expected develop to track origin/develop, got %s %s", branch.Remote, branch.Merge)
+	}
+
+	if err := gitCheckoutBranch(repo, "missing"); err == nil {
+		t.Error("expected checking out a missing branch to fail")
+	}
+}
+
+func TestGitOpenWorktreeChecksOutBaseBranch(t *testing.T) {
+	remote, _ := initTestRemote(t)
+	dir := t.TempDir()
+	if _, err := gitCloneBranch(remote, dir, nil, "develop", 0, git.NoTags, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := gitOpenWorktree(dir, "master", remote, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name() != gitRefName("master") {
+		t.Errorf("expected master to be checked out, got %s", head.Name())
+	}
+}
+
+func TestGitOpenWorktreeRemoteMismatchKeepsCheckout(t *testing.T) {
+	remote, _ := initTestRemote(t)
+	dir := t.TempDir()
+	if _, err := gitCloneBranch(remote, dir, nil, "develop", 0, git.NoTags, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gitOpenWorktree(dir, "master", "https://example.com/other.git", false); err == nil {
+		t.Fatal("expected a different origin to be rejected")
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name() != gitRefName("develop") {
+		t.Errorf("expected develop to stay checked out, got %s", head.Name())
+	}
+}
+
+func TestGitResolveCommit(t *testing.T) {
+	dir, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+	second := commitTestFiles(t, repo, dir, map[string]string{"CHANGELOG.md": "changes"}, "second commit")
+
+	for _, sha := range []string{second.String(), second.String()[:7], strings.ToUpper(second.String()[:10])} {
+		hash, err := gitResolveCommit(repo, sha)
+		if err != nil {
+			t.Errorf("%s: %v", sha, err)
+			continue
+		}
+		if hash != second {
+			t.Errorf("%s: expected %s, got %s", sha, second, hash)
+		}
+	}
+
+	for _, sha := range []string{"master", "0000000", "abc"} {
+		if _, err := gitResolveCommit(repo, sha); err == nil {
+			t.Errorf("%s: expected an error", sha)
+		}
+	}
+}
+
+// testSignKey generates a gpg key and returns its armored private and public key
+func testSignKey(t *testing.T) (string, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("Release Bot", "", "release@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var private, public bytes.Buffer
+	writer, err := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(writer, nil); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	writer, err = armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return private.String(), public.String()
+}
+
+func TestSignedCommitAndTag(t *testing.T) {
+	private, public := testSignKey(t)
+	signKey, err := loadSignKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+	writeTestFile(t, filepath.Join(dir, "TAGFILE.txt"), "1.2.3\n")
+	if err := gitAddAll(repo); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := gitCommit(repo, "[skip ci] Update version, tagfile", testSignature(), signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.PGPSignature == "" {
+		t.Fatal("expected the commit to be signed")
+	}
+	if _, err := commit.Verify(public); err != nil {
+		t.Errorf("commit signature does not verify: %v", err)
+	}
+
+	cfg := testConfig()
+	cfg.AuthorName = "Release Bot"
+	cfg.AuthorEmail = "release@example.com"
+	opts, err := tagOptions(cfg, "1.2.3", "1.2.3", "", signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gitTag(repo, "1.2.3", opts); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Tag("1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := repo.TagObject(ref.Hash())
+	if err != nil {
+		t.Fatalf("expected an annotated tag: %v", err)
+	}
+	if tag.Target != hash {
+		t.Errorf("expected the tag to point to %s, got %s", hash, tag.Target)
+	}
+	if _, err := tag.Verify(public); err != nil {
+		t.Errorf("tag signature does not verify: %v", err)
+	}
+}
+
+func TestGitHeadEmptyRepository(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitHead(repo); err == nil || !strings.Contains(err.Error(), "no commits") {
+		t.Errorf("expected an error about the missing commits, got %v", err)
+	}
+	if err := gitTag(repo, "1.2.3", nil); err == nil {
+		t.Error("expected tagging an empty repository to fail")
+	}
+}
+
+func TestGitTagDetachedHead(t *testing.T) {
+	dir, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+	first, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitTestFiles(t, repo, dir, map[string]string{"CHANGELOG.md": "changes"}, "second commit")
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: first.Hash()}); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := gitHead(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != first.Hash() {
+		t.Errorf("expected the detached HEAD %s, got %s", first.Hash(), head.Hash())
+	}
+	if err := gitTag(repo, "1.2.3", nil); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Tag("1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != first.Hash() {
+		t.Errorf("expected the tag to point to the detached HEAD %s, got %s", first.Hash(), ref.Hash())
+	}
+	if err := gitTag(repo, "1.2.3", nil); err != git.ErrTagExists {
+		t.Errorf("expected ErrTagExists, got %v", err)
+	}
+}
+
+func TestGitOpenWorktreeDirty(t *testing.T) {
+	remote, _ := initTestRemote(t)
+	dir := t.TempDir()
+	if _, err := gitCloneBranch(remote, dir, nil, "master", 0, git.NoTags, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, "local.properties"), "sdk.dir=/opt/android")
+
+	if _, err := gitOpenWorktree(dir, "master", remote, false); err == nil || !strings.Contains(err.Error(), "uncommitted changes") {
+		t.Errorf("expected a dirty worktree to be rejected, got %v", err)
+	}
+	if _, err := gitOpenWorktree(dir, "master", remote, true); err != nil {
+		t.Errorf("expected a dirty worktree to be accepted with commit_paths, got %v", err)
+	}
+}
+
+func TestGitHasStagedChanges(t *testing.T) {
+	dir, repo := initTestRepo(t, map[string]string{"TAGFILE": "v1.0.0\n", "version.properties": "versionCode=1\n"})
+	writeTestFile(t, filepath.Join(dir, "TAGFILE"), "v1.0.0\n")
+	writeTestFile(t, filepath.Join(dir, "local.properties"), "sdk.dir=/opt/android")
+	if err := gitAddPaths(repo, []string{"TAGFILE"}); err != nil {
+		t.Fatal(err)
+	}
+	if staged, err := gitHasStagedChanges(repo); err != nil || staged {
+		t.Errorf("expected an unchanged tag file and an untracked file to stage nothing, got %v (%v)", staged, err)
+	}
+
+	writeTestFile(t, filepath.Join(dir, "version.properties"), "versionCode=2\n")
+	if err := gitAddAll(repo); err != nil {
+		t.Fatal(err)
+	}
+	if staged, err := gitHasStagedChanges(repo); err != nil || !staged {
+		t.Errorf("expected the version bump to be staged, got %v (%v)", staged, err)
+	}
+}
+
+func TestGitCloneWithReferenceKeepsExistingRepository(t *testing.T) {
+	remote, _ := initTestRemote(t)
+	dir, _ := initTestRepo(t, map[string]string{"local.txt": "local"})
+	if _, err := gitCloneWithReference(remote, dir, nil, "master", remote, git.NoTags); err != git.ErrRepositoryAlreadyExists {
+		t.Fatalf("expected %v, got %v", git.ErrRepositoryAlreadyExists, err)
+	}
+	if _, err := git.PlainOpen(dir); err != nil {
+		t.Errorf("expected the existing repository to be kept, got %v", err)
+	}
+}
+
+func TestProcessTagFileReturnsPushedTagsWhenMirrorFails(t *testing.T) {
+	remote, _ := initTestRemote(t)
+	dir := t.TempDir()
+	repo, err := gitCloneBranch(remote, dir, nil, "master", 0, git.NoTags, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "TAGFILE.txt")
+	writeTestFile(t, path, "1.2.3\n")
+	cfg := testConfig()
+	cfg.TagType = "lightweight"
+	cfg.TagRemoteUrl = filepath.Join(t.TempDir(), "missing-mirror.git")
+
+	tags, err := processTagFile(repo, nil, cfg, nil, path, nil)
+	if err == nil {
+		t.Fatal("expected pushing to the mirror to fail")
+	}
+	if len(tags) != 1 || tags[0] != "1.2.3" {
+		t.Errorf("expected the tag pushed to origin to be returned, got %v", tags)
+	}
+	remoteRepo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteRepo.Reference(plumbing.NewTagReferenceName("1.2.3"), true); err != nil {
+		t.Errorf("expected 1.2.3 to be pushed to origin, got %v", err)
+	}
+}
+
+func TestGitPushTagsSkipsExistingNamespacedTags(t *testing.T) {
+	remote, develop := initTestRemote(t)
+	remoteRepo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteRepo.CreateTag("mobile/1.2.3", develop, nil); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := gitCloneBranch(remote, t.TempDir(), nil, "master", 0, git.NoTags, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.TagNamespace = "/mobile/"
+	var tagNames []string
+	for _, version := range []string{"1.2.3", "1.3.0"} {
+		tagName := cfg.namespacedTag(version)
+		if err := gitTag(repo, tagName, nil); err != nil {
+			t.Fatal(err)
+		}
+		tagNames = append(tagNames, tagName)
+	}
+
+	remoteTags, err := gitRemoteTags(repo, git.DefaultRemoteName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remoteTags["mobile/1.2.3"] {
+		t.Fatalf("expected the namespaced remote tag to be listed, got %v", remoteTags)
+	}
+	pushed, err := gitPushTags(repo, git.DefaultRemoteName, nil, cfg, tagNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 1 || pushed[0] != "mobile/1.3.0" {
+		t.Errorf("expected only mobile/1.3.0 to be pushed, got %v", pushed)
+	}
+	ref, err := remoteRepo.Reference(plumbing.NewTagReferenceName("mobile/1.2.3"), true)
+	if err != nil || ref.Hash() != develop {
+		t.Errorf("expected the existing remote tag to be kept at %s, got %v", develop, err)
+	}
+	if _, err := remoteRepo.Reference(plumbing.NewTagReferenceName("mobile/1.3.0"), true); err != nil {
+		t.Errorf("expected mobile/1.3.0 to be pushed, got %v", err)
+	}
+}
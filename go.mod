@@ -6,4 +6,5 @@ require (
 	github.com/bitrise-io/go-steputils v0.0.0-20201016102104-03ae3a6ded35
 	github.com/bitrise-io/go-utils v0.0.0-20201019131314-6cc2aa4d248a
 	github.com/go-git/go-git/v5 v5.2.0
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 )
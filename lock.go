@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// acquireLock takes an advisory lock next to dir so that concurrent runs on a shared runner don't clone into
+// the same directory. The lock is released by the returned func or when the process exits.
+func acquireLock(dir string, timeout time.Duration) (func(), error) {
+	path := filepath.Clean(dir) + ".lock"
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to open lock file %s: %v\n", path, err))
+	}
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			_ = file.Close()
+			return nil, errors.New(fmt.Sprintf("unable to lock %s: %v\n", path, err))
+		}
+		if time.Now().After(deadline) {
+			_ = file.Close()
+			return nil, errors.New(fmt.Sprintf("unable to lock %s: still held by another run after %s\n", path, timeout))
+		}
+		if !waiting {
+			log.Warnf("%s is locked by another run, waiting up to %s", path, timeout)
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
@@ -2,246 +2,1193 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/bitrise-io/go-steputils/stepconf"
+	"github.com/bitrise-io/go-steputils/tools"
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/openpgp"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
+// stepVersion is set at build time with -ldflags "-X main.stepVersion=<version>"
+var stepVersion = "0.0.1"
+
 type Config struct {
-	SourceDir             string          `env:"BITRISE_SOURCE_DIR,required"`
-	SSHPrivateKeyPath     string          `env:"ssh_key_save_path,required"`
-	Username              string          `env:"git_http_username,required"`
-	AccessToken           stepconf.Secret `env:"access_token,required"`
-	CloneUrl              string          `env:"git_repo_url,required"`
-	VersionCodeFile       string          `env:"version_code_file,required"`
-	ReleaseBranchTemplate string          `env:"release_branch_template,required"`
-	VersionCodeTemplate   string          `env:"version_code_template,required"`
-	VersionCodeRegex      string          `env:"version_code_regex,required"`
-	TagFile               string          `env:"tag_file,required"`
-	TagFileTemplete       string          `env:"tag_file_template,required"`
+	SourceDir                         string          `env:"BITRISE_SOURCE_DIR,required"`
+	SSHPrivateKeyPath                 string          `env:"ssh_key_save_path"`
+	SSHUseAgent                       bool            `env:"ssh_use_agent,opt[yes,no]"`
+	SSHKeyPassphrase                  stepconf.Secret `env:"ssh_key_passphrase"`
+	SSHKnownHostsFile                 string          `env:"ssh_known_hosts_file"`
+	InsecureIgnoreHostKey             bool            `env:"insecure_ignore_host_key,opt[yes,no]"`
+	Username                          string          `env:"git_http_username,required"`
+	AccessToken                       stepconf.Secret `env:"access_token"`
+	NetrcPath                         string          `env:"netrc_path"`
+	GithubAppId                       string          `env:"github_app_id"`
+	GithubAppInstallationId           string          `env:"github_app_installation_id"`
+	GithubAppPrivateKey               stepconf.Secret `env:"github_app_private_key"`
+	CloneUrl                          string          `env:"git_repo_url,required"`
+	PushUrl                           string          `env:"push_url"`
+	PushSSHKeyPath                    string          `env:"push_ssh_key_path"`
+	PushAccessToken                   stepconf.Secret `env:"push_access_token"`
+	BaseBranch                        string          `env:"base_branch,required"`
+	BaseCommit                        string          `env:"base_commit"`
+	BaseTag                           string          `env:"base_tag"`
+	CloneDepth                        int             `env:"clone_depth"`
+	CloneTags                         string          `env:"clone_tags,opt[all,following,none]"`
+	CloneReferencePath                string          `env:"clone_reference_path"`
+	UseExistingClone                  bool            `env:"use_existing_clone,opt[yes,no]"`
+	ExistingClonePath                 string          `env:"existing_clone_path"`
+	AuthorName                        string          `env:"git_author_name,required"`
+	AuthorEmail                       string          `env:"git_author_email,required"`
+	SignOff                           bool            `env:"sign_off,opt[yes,no]"`
+	GPGPrivateKey                     stepconf.Secret `env:"gpg_private_key"`
+	GPGKeyPassphrase                  stepconf.Secret `env:"gpg_key_passphrase"`
+	EnableVersionCode                 bool            `env:"enable_version_code,opt[yes,no]"`
+	VersionCodeFile                   string          `env:"version_code_file"`
+	ReleaseBranchTemplate             string          `env:"release_branch_template,required"`
+	WeekStart                         string          `env:"week_start,opt[iso,monday,sunday]"`
+	BranchNameSanitize                string          `env:"branch_name_sanitize,opt[reject,replace]"`
+	VersionCodeTemplate               string          `env:"version_code_template"`
+	VersionCodeIncrement              int             `env:"version_code_increment"`
+	VersionCodeSource                 string          `env:"version_code_source,opt[file,bitrise_build_number,max_tag]"`
+	BuildNumber                       int             `env:"build_number"`
+	VersionCodeOffset                 int             `env:"version_code_offset"`
+	VersionCodeTagPattern             string          `env:"version_code_tag_pattern"`
+	VersionCodeTagBase                int             `env:"version_code_tag_base"`
+	VersionCodeMax                    int             `env:"version_code_max"`
+	VersionCodeRegex                  string          `env:"version_code_regex"`
+	VersionNameRegex                  string          `env:"version_name_regex"`
+	VersionNameTemplate               string          `env:"version_name_template"`
+	VersionCodeMatch                  string          `env:"version_code_match,opt[all,first]"`
+	VersionCodeFormat                 string          `env:"version_code_format,opt[regex,plist,pubspec,package_json,xml,properties,toml]"`
+	VersionCodeXmlSelector            string          `env:"version_code_xml_selector"`
+	VersionCodeKey                    string          `env:"version_code_key"`
+	VersionCodeTomlKey                string          `env:"version_code_toml_key"`
+	VersionPart                       string          `env:"version_part,opt[auto,build,patch]"`
+	EnableTags                        bool            `env:"enable_tags,opt[yes,no]"`
+	TagFile                           string          `env:"tag_file"`
+	SkipEmptyTagFiles                 bool            `env:"skip_empty_tag_files,opt[yes,no]"`
+	TagFileCommentPrefix              string          `env:"tag_file_comment_prefix"`
+	RefreshTags                       bool            `env:"refresh_tags,opt[yes,no]"`
+	TagFileTemplete                   string          `env:"tag_file_template"`
+	TagScheme                         string          `env:"tag_scheme,opt[semver,calver]"`
+	BumpLevel                         string          `env:"bump_level,opt[major,minor,patch]"`
+	TagInclude                        string          `env:"tag_include"`
+	TagPushFilter                     string          `env:"tag_push_filter"`
+	TagNamePrefix                     string          `env:"tag_name_prefix"`
+	TagNamespace                      string          `env:"tag_namespace"`
+	TagNameSuffix                     string          `env:"tag_name_suffix"`
+	TagMessageTemplate                string          `env:"tag_message_template"`
+	TagType                           string          `env:"tag_type,opt[auto,lightweight,annotated]"`
+	TagRemoteUrl                      string          `env:"tag_remote_url"`
+	TagRemoteAccessToken              stepconf.Secret `env:"tag_remote_auth"`
+	DryRun                            bool            `env:"dry_run,opt[yes,no]"`
+	BumpTargetBranch                  string          `env:"bump_target_branch"`
+	CommitPaths                       string          `env:"commit_paths"`
+	GenerateChangelog                 bool            `env:"generate_changelog,opt[yes,no]"`
+	ChangelogPath                     string          `env:"changelog_path"`
+	PrePushCommand                    string          `env:"pre_push_command"`
+	ShowDiff                          bool            `env:"show_diff,opt[yes,no]"`
+	LogFormat                         string          `env:"log_format,opt[text,json]"`
+	PushRetries                       int             `env:"push_retries,range[0..10]"`
+	CloneRetries                      int             `env:"clone_retries,range[0..10]"`
+	NetworkTimeoutSeconds             int             `env:"network_timeout_seconds"`
+	LockSourceDir                     bool            `env:"lock_source_dir,opt[yes,no]"`
+	LockTimeoutSeconds                int             `env:"lock_timeout_seconds"`
+	ForcePush                         bool            `env:"force_push,opt[yes,no]"`
+	PushReleaseAs                     string          `env:"push_release_as"`
+	OnBranchExists                    string          `env:"on_branch_exists,opt[fail,skip,reuse,overwrite]"`
+	DeleteReleaseBranchAfterPush      bool            `env:"delete_release_branch_after_push,opt[yes,no]"`
+	SkipIfNoChanges                   bool            `env:"skip_if_no_changes,opt[yes,no]"`
+	CreateDivergeCommit               bool            `env:"create_diverge_commit,opt[yes,no]"`
+	DivergeCommitMessage              string          `env:"diverge_commit_message"`
+	CleanupOnFailure                  bool            `env:"cleanup_on_failure,opt[yes,no]"`
+	CreatePullRequest                 bool            `env:"create_pull_request,opt[yes,no]"`
+	PullRequestTitleTemplate          string          `env:"pr_title_template"`
+	PullRequestBase                   string          `env:"pr_base"`
+	CreateMergeRequest                bool            `env:"create_merge_request,opt[yes,no]"`
+	MergeRequestTargetBranch          string          `env:"mr_target_branch"`
+	MergeRequestTitleTemplate         string          `env:"mr_title_template"`
+	CreateBitbucketPullRequest        bool            `env:"create_bitbucket_pull_request,opt[yes,no]"`
+	BitbucketPullRequestDestination   string          `env:"bitbucket_pr_destination"`
+	BitbucketPullRequestTitleTemplate string          `env:"bitbucket_pr_title_template"`
+	SlackWebhookUrl                   stepconf.Secret `env:"slack_webhook_url"`
+	PostReleaseWebhookUrl             stepconf.Secret `env:"post_release_webhook_url"`
+	WebhookRequired                   bool            `env:"webhook_required,opt[yes,no]"`
+}
+
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (cfg *Config) versionCodeFilePaths() []string {
+	var paths []string
+	for _, entry := range splitList(cfg.VersionCodeFile) {
+		paths = append(paths, cfg.sourcePath(entry))
+	}
+	return paths
+}
+
+func (cfg *Config) sourcePath(file string) string {
+	return fmt.Sprintf("%s/%s", cfg.SourceDir, file)
+}
+
+func (cfg *Config) tagFilePaths() []string {
+	var paths []string
+	for _, entry := range splitList(cfg.TagFile) {
+		paths = append(paths, cfg.sourcePath(entry))
+	}
+	return paths
+}
+
+func (cfg *Config) isTagFileComment(line string) bool {
+	return cfg.TagFileCommentPrefix != "" && strings.HasPrefix(line, cfg.TagFileCommentPrefix)
+}
+
+func (cfg *Config) signature(when time.Time) *object.Signature {
+	return &object.Signature{
+		Name:  cfg.AuthorName,
+		Email: cfg.AuthorEmail,
+		When:  when,
+	}
+}
+
+// commitMessage appends the DCO sign-off trailer when sign_off is enabled
+func (cfg *Config) commitMessage(message string) string {
+	if !cfg.SignOff {
+		return message
+	}
+	return fmt.Sprintf("%s\n\nSigned-off-by: %s <%s>", strings.TrimRight(message, "\n"), cfg.AuthorName, cfg.AuthorEmail)
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg.BaseCommit != "" && !isCommitSha(cfg.BaseCommit) {
+		return errors.New(fmt.Sprintf("base_commit is not a commit sha: %s", cfg.BaseCommit))
+	}
+	if cfg.BaseCommit != "" && cfg.BaseTag != "" {
+		return errors.New("base_commit and base_tag can't be used together")
+	}
+	if cfg.BaseTag != "" && cfg.CloneTags == "none" {
+		return errors.New("base_tag needs the tag to be cloned, clone_tags can't be none")
+	}
+	if cfg.EnableVersionCode {
+		inputs := [][2]string{
+			{"version_code_file", cfg.VersionCodeFile},
+			{"version_code_template", cfg.VersionCodeTemplate},
+		}
+		switch cfg.VersionCodeFormat {
+		case "xml":
+			inputs = append(inputs, [2]string{"version_code_xml_selector", cfg.VersionCodeXmlSelector})
+		case "properties":
+			inputs = append(inputs, [2]string{"version_code_key", cfg.VersionCodeKey})
+		case "toml":
+			inputs = append(inputs, [2]string{"version_code_toml_key", cfg.VersionCodeTomlKey})
+		case "plist", "pubspec", "package_json":
+		default:
+			inputs = append(inputs, [2]string{"version_code_regex", cfg.VersionCodeRegex})
+		}
+		if cfg.VersionNameRegex != "" {
+			inputs = append(inputs, [2]string{"version_name_template", cfg.VersionNameTemplate})
+		}
+		if err := requireInputs("enable_version_code", inputs); err != nil {
+			return err
+		}
+		if cfg.VersionCodeIncrement < 1 {
+			return errors.New(fmt.Sprintf("version_code_increment must be positive: %d", cfg.VersionCodeIncrement))
+		}
+		if cfg.VersionCodeSource == "bitrise_build_number" && cfg.BuildNumber < 1 {
+			return errors.New("version_code_source is bitrise_build_number but build_number is not set")
+		}
+		if cfg.VersionCodeSource == "max_tag" {
+			if err := requireInputs("version_code_source max_tag", [][2]string{{"version_code_tag_pattern", cfg.VersionCodeTagPattern}}); err != nil {
+				return err
+			}
+			if _, err := regexp.Compile(cfg.VersionCodeTagPattern); err != nil {
+				return errors.New(fmt.Sprintf("invalid version_code_tag_pattern: %v", err))
+			}
+		}
+	}
+	if cfg.EnableTags {
+		if err := requireInputs("enable_tags", [][2]string{
+			{"tag_file", cfg.TagFile},
+			{"tag_file_template", cfg.TagFileTemplete},
+		}); err != nil {
+			return err
+		}
+	}
+	if cfg.GithubAppId != "" && (cfg.GithubAppInstallationId == "" || cfg.GithubAppPrivateKey == "") {
+		return errors.New("github_app_installation_id and github_app_private_key are required with github_app_id")
+	}
+	if strings.HasPrefix(cfg.CloneUrl, "http") && cfg.AccessToken == "" && cfg.GithubAppId == "" && cfg.NetrcPath == "" {
+		return errors.New("access_token or netrc_path is required for http remotes")
+	}
+	if cfg.TagType == "lightweight" && (cfg.TagMessageTemplate != "" || cfg.GPGPrivateKey != "") {
+		return errors.New("tag_type lightweight can't be combined with tag_message_template or gpg_private_key, lightweight tags have no message or signature")
+	}
+	if cfg.CloneTags == "none" && (cfg.SkipIfNoChanges || cfg.GenerateChangelog) {
+		return errors.New("skip_if_no_changes and generate_changelog need the existing tags, clone_tags can't be none")
+	}
+	if cfg.UseExistingClone && cfg.ExistingClonePath != "" {
+		return errors.New("use_existing_clone and existing_clone_path can't be used together")
+	}
+	if cfg.DeleteReleaseBranchAfterPush && (cfg.CreatePullRequest || cfg.CreateMergeRequest || cfg.CreateBitbucketPullRequest) {
+		return errors.New("delete_release_branch_after_push would close the pull request opened from the release branch")
+	}
+	if cfg.GenerateChangelog && cfg.ChangelogPath == "" {
+		return errors.New("changelog_path is required with generate_changelog")
+	}
+	if cfg.VersionCodeFormat == "xml" {
+		if _, err := parseXmlSelector(cfg.VersionCodeXmlSelector); err != nil {
+			return errors.New(fmt.Sprintf("invalid version_code_xml_selector: %v", err))
+		}
+	}
+	if _, err := regexp.Compile(cfg.VersionCodeRegex); err != nil {
+		return errors.New(fmt.Sprintf("invalid version_code_regex: %v", err))
+	}
+	if _, err := regexp.Compile(cfg.VersionNameRegex); err != nil {
+		return errors.New(fmt.Sprintf("invalid version_name_regex: %v", err))
+	}
+	if _, err := regexp.Compile(cfg.TagPushFilter); err != nil {
+		return errors.New(fmt.Sprintf("invalid tag_push_filter: %v", err))
+	}
+	if _, err := regexp.Compile(cfg.TagInclude); err != nil {
+		return errors.New(fmt.Sprintf("invalid tag_include: %v", err))
+	}
+	templates := []struct {
+		input string
+		text  string
+	}{
+		{"release_branch_template", cfg.ReleaseBranchTemplate},
+		{"version_code_template", cfg.VersionCodeTemplate},
+		{"version_name_template", cfg.VersionNameTemplate},
+		{"tag_file_template", cfg.TagFileTemplete},
+		{"diverge_commit_message", cfg.DivergeCommitMessage},
+		{"tag_name_suffix", cfg.TagNameSuffix},
+		{"tag_message_template", cfg.TagMessageTemplate},
+		{"pr_title_template", cfg.PullRequestTitleTemplate},
+		{"mr_title_template", cfg.MergeRequestTitleTemplate},
+		{"bitbucket_pr_title_template", cfg.BitbucketPullRequestTitleTemplate},
+	}
+	for _, t := range templates {
+		if _, err := parseTemplate(cfg, t.input, t.text); err != nil {
+			return errors.New(fmt.Sprintf("invalid %s: %v", t.input, err))
+		}
+	}
+	return nil
 }
 
-func (cfg *Config) versionCodeFilePath() string {
-	return fmt.Sprintf("%s/%s", cfg.SourceDir, cfg.VersionCodeFile)
+func requireInputs(feature string, inputs [][2]string) error {
+	var missing []string
+	for _, input := range inputs {
+		if strings.TrimSpace(input[1]) == "" {
+			missing = append(missing, input[0])
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New(fmt.Sprintf("%s is enabled but %s not set, set them or disable %s", feature, strings.Join(missing, ", "), feature))
+	}
+	return nil
 }
 
-func (cfg *Config) tagFilePath() string {
-	return fmt.Sprintf("%s/%s", cfg.SourceDir, cfg.TagFile)
+func runPrePushCommand(cfg *Config) error {
+	log.Infof("Running pre-push command: %s", cfg.PrePushCommand)
+	cmd := exec.Command("sh", "-c", cfg.PrePushCommand)
+	cmd.Dir = cfg.SourceDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	logEvent("info", "pre-push", "Pre-push command succeeded")
+	return nil
+}
+
+func exportReleaseCreated(created bool) {
+	if err := tools.ExportEnvironmentWithEnvman("RELEASE_CREATED", strconv.FormatBool(created)); err != nil {
+		fail("Unable to export RELEASE_CREATED: %v\n", err)
+	}
 }
 
 func fail(format string, args ...interface{}) {
+	logEvent("error", "run", "%s", strings.TrimSpace(fmt.Sprintf(format, args...)))
 	log.Errorf(format, args...)
 	os.Exit(1)
 }
 
-func updateBuildNo(cfg *Config) error {
-	file, _ := os.OpenFile(cfg.versionCodeFilePath(), os.O_RDWR, 0644)
-	defer file.Close()
-	reader := bufio.NewScanner(file)
-	writer := bufio.NewWriter(file)
+// lineEnding is the dominant line ending of a file and whether its last line was terminated by one
+type lineEnding struct {
+	eol   string
+	final bool
+}
 
-	var lines []string
+// readLines splits the file into lines without their line endings and returns the line ending
+// so that it can be preserved when the file is rewritten
+func readLines(file *os.File) ([]string, lineEnding, error) {
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, lineEnding{}, err
+	}
+	text := string(content)
+	eol := lineEnding{eol: "\n", final: text == "" || strings.HasSuffix(text, "\n")}
+	crlf := strings.Count(text, "\r\n")
+	if crlf > 0 && crlf >= strings.Count(text, "\n")-crlf {
+		eol.eol = "\r\n"
+	}
 
-	buildVersionRe, err := regexp.Compile(cfg.VersionCodeRegex)
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil, eol, nil
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines, eol, nil
+}
+
+func rewriteLines(file *os.File, lines []string, eol lineEnding) error {
+	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for i, line := range lines {
+		_, _ = writer.WriteString(line)
+		if i < len(lines)-1 || eol.final {
+			_, _ = writer.WriteString(eol.eol)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	// writing can clear the setuid/setgid bits, reapply the mode the file had before it was rewritten
+	return file.Chmod(info.Mode())
+}
 
-	replaced := false
-	for reader.Scan() {
-		line := reader.Text()
+func logLineDiff(path string, original []string, lines []string) {
+	log.Printf("--- a/%s", path)
+	log.Printf("+++ b/%s", path)
+	for i := range lines {
+		if i < len(original) && original[i] == lines[i] {
+			continue
+		}
+		log.Printf("@@ -%d +%d @@", i+1, i+1)
+		if i < len(original) {
+			log.Printf("-%s", original[i])
+		}
+		log.Printf("+%s", lines[i])
+	}
+}
 
-		if buildVersionRe.MatchString(line) {
-			replaced = true
-			verCodeRe := regexp.MustCompile(`\d+`)
-			match := verCodeRe.FindString(line)
-			verCode, err := strconv.Atoi(match)
-			if err != nil {
-				panic("Unable to parse versionCode")
-			}
+func writeChangedLines(cfg *Config, file *os.File, original []string, lines []string, eol lineEnding) error {
+	if cfg.ShowDiff || cfg.DryRun {
+		logLineDiff(file.Name(), original, lines)
+	}
+	if cfg.DryRun {
+		log.Warnf("Dry run: not writing %s", file.Name())
+		return nil
+	}
+	return rewriteLines(file, lines, eol)
+}
+
+// Semver is a version of the tag file, Suffix is the prerelease (after "-") and Build the build metadata (after "+").
+// Parts holds every numeric component in order, Major, Minor and Rev are the first three of them.
+type Semver struct {
+	Major  int
+	Minor  int
+	Rev    int
+	Parts  []int
+	Suffix string
+	Build  string
+}
+
+func newSemver(parts []int, suffix string, build string) Semver {
+	for len(parts) < 3 {
+		parts = append(parts, 0)
+	}
+	return Semver{Major: parts[0], Minor: parts[1], Rev: parts[2], Parts: parts, Suffix: suffix, Build: build}
+}
+
+// parts keeps Major, Minor and Rev authoritative for versions that were built without Parts
+func (semver Semver) parts() []int {
+	parts := []int{semver.Major, semver.Minor, semver.Rev}
+	if len(semver.Parts) > 3 {
+		parts = append(parts, semver.Parts[3:]...)
+	}
+	return parts
+}
+
+func (semver Semver) String() string {
+	var numbers []string
+	for _, part := range semver.parts() {
+		numbers = append(numbers, strconv.Itoa(part))
+	}
+	version := strings.Join(numbers, ".")
+	if semver.Suffix != "" {
+		version += "-" + semver.Suffix
+	}
+	if semver.Build != "" {
+		version += "+" + semver.Build
+	}
+	return version
+}
+
+func (semver Semver) Bump(level string) Semver {
+	var bumped Semver
+	switch level {
+	case "major":
+		bumped, _ = semver.BumpPart(0)
+	case "minor":
+		bumped, _ = semver.BumpPart(1)
+	default:
+		bumped, _ = semver.BumpPart(2)
+	}
+	return bumped
+}
+
+// BumpPart increments the numeric component at index and resets the ones after it
+func (semver Semver) BumpPart(index int) (Semver, error) {
+	parts := semver.parts()
+	if index < 0 || index >= len(parts) {
+		return semver, errors.New(fmt.Sprintf("version %s has no part %d", semver, index))
+	}
+	parts[index]++
+	for i := index + 1; i < len(parts); i++ {
+		parts[i] = 0
+	}
+	return newSemver(parts, semver.Suffix, semver.Build), nil
+}
+
+// BumpPrerelease increments the last numeric identifier of the prerelease, "rc.1" becomes "rc.2" and "rc" becomes "rc.1"
+func (semver Semver) BumpPrerelease() (Semver, error) {
+	if semver.Suffix == "" {
+		return semver, errors.New(fmt.Sprintf("version has no prerelease to bump: %s", semver))
+	}
+	identifiers := strings.Split(semver.Suffix, ".")
+	last := len(identifiers) - 1
+	if counter, err := strconv.Atoi(identifiers[last]); err == nil {
+		identifiers[last] = strconv.Itoa(counter + 1)
+	} else {
+		identifiers = append(identifiers, "1")
+	}
+	semver.Suffix = strings.Join(identifiers, ".")
+	return semver, nil
+}
 
-			var out bytes.Buffer
-			funcMap := template.FuncMap{
-				"add":
-				func(i int, what int) int {
-					return i + what
-				},
+// the revision is optional, "1.2-suffix" is read as "1.2.0-suffix". Any further parts ("1.2.3.4") end up in Extra.
+var tagFileRe = regexp.MustCompile(`(?:^|[^\d.])(?P<Major>\d+)\.(?P<Minor>\d+)(?:\.(?P<Rev>\d+)(?P<Extra>(?:\.\d+)*))?(?:-(?P<Suffix>[^+]+))?(?:\+(?P<Build>.+))?$`)
+
+func parseSemver(line string) (Semver, error) {
+	matches := tagFileRe.FindStringSubmatch(strings.TrimSpace(line))
+	if matches == nil {
+		return Semver{}, errors.New(fmt.Sprintf("tag format is not using semantic versioning, expected X.Y.Z[.N...][-prerelease][+build]: %s", line))
+	}
+	paramsMap := make(map[string]string)
+	for i, name := range tagFileRe.SubexpNames() {
+		if i > 0 && i < len(matches) {
+			paramsMap[name] = matches[i]
+		}
+	}
+	if paramsMap["Rev"] == "" {
+		paramsMap["Rev"] = "0"
+	}
+	components := []string{paramsMap["Major"], paramsMap["Minor"], paramsMap["Rev"]}
+	if paramsMap["Extra"] != "" {
+		components = append(components, strings.Split(strings.TrimPrefix(paramsMap["Extra"], "."), ".")...)
+	}
+	componentNames := []string{"major", "minor", "rev"}
+	var parts []int
+	for i, component := range components {
+		part, err := strconv.Atoi(component)
+		if err != nil {
+			name := fmt.Sprintf("part %d", i+1)
+			if i < len(componentNames) {
+				name = componentNames[i]
 			}
-			t1, _ := template.New("verCode").Funcs(funcMap).Parse(cfg.VersionCodeTemplate)
-			_ = t1.Execute(&out, verCode)
-			verCodeNew, _ := strconv.Atoi(out.String())
-			line = strings.Replace(line, match, strconv.Itoa(verCodeNew), 1)
+			return Semver{}, errors.New(fmt.Sprintf("invalid %s version component %q in tag: %s", name, component, line))
 		}
-		lines = append(lines, line)
+		parts = append(parts, part)
 	}
+	return newSemver(parts, paramsMap["Suffix"], paramsMap["Build"]), nil
+}
 
-	if !replaced {
-		fail("failed")
+var calverRe = regexp.MustCompile(`^(?P<Major>\d{4})\.(?P<Minor>\d{1,2})\.(?P<Rev>\d+)(?:-(?P<Suffix>.+))?$`)
+
+func parseCalver(line string) (Semver, error) {
+	matches := calverRe.FindStringSubmatch(line)
+	if matches == nil {
+		return Semver{}, errors.New(fmt.Sprintf("tag format is not using calendar versioning (YYYY.MM.N): %s", line))
 	}
+	year, _ := strconv.Atoi(matches[1])
+	month, _ := strconv.Atoi(matches[2])
+	counter, _ := strconv.Atoi(matches[3])
+	return Semver{Major: year, Minor: month, Rev: counter, Suffix: matches[4]}, nil
+}
 
-	_, _ = file.Seek(0, 0)
-	for _, line := range lines {
-		_, _ = writer.WriteString(line)
-		_ = writer.WriteByte(10)
+func parseTagVersion(cfg *Config, line string) (Semver, error) {
+	if cfg.TagScheme == "calver" {
+		return parseCalver(line)
 	}
-	err = writer.Flush()
-	if err != nil {
-		return err
+	return parseSemver(line)
+}
+
+type CalverContext struct {
+	Semver
+	Previous Semver
+	time.Time
+}
+
+// nextCalver takes year and month from now, the counter is only incremented within the same month
+func nextCalver(previous Semver, now time.Time) CalverContext {
+	next := Semver{Major: now.Year(), Minor: int(now.Month()), Suffix: previous.Suffix}
+	if previous.Major == next.Major && previous.Minor == next.Minor {
+		next.Rev = previous.Rev + 1
 	}
+	return CalverContext{Semver: next, Previous: previous, Time: now}
+}
 
-	return nil
+// TagFileVersions holds the first bumped version of every section of a tag file, "" for the lines before the first section
+type TagFileVersions map[string]*Semver
+
+// TagFileUpdate is the result of bumping a tag file, Old and New are the first version of the file before and after the bump
+type TagFileUpdate struct {
+	Versions TagFileVersions
+	Old      string
+	New      string
 }
 
-func updateTagFile(cfg *Config) error {
-	type Semver struct {
-		Major  int
-		Minor  int
-		Rev    int
-		Suffix string
+var tagSectionRe = regexp.MustCompile(`^\s*\[([^\]]+)\]\s*`)
+
+// splitTagSection splits a "[ios] 1.2.3" line into its label ("[ios] "), the section and the rest of the line,
+// the section stays current until the next label
+func splitTagSection(line string, current string) (string, string, string) {
+	matches := tagSectionRe.FindStringSubmatch(line)
+	if matches == nil {
+		return "", current, line
+	}
+	return matches[0], strings.TrimSpace(matches[1]), line[len(matches[0]):]
+}
+
+// updateTagFile bumps every version line of the tag file and returns the first bumped version of every section,
+// which is nil when the rendered version can't be parsed. Template lines are left untouched.
+func updateTagFile(cfg *Config, path string, now time.Time) (*TagFileUpdate, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to open tag file %s: %v", path, err))
 	}
-	file, _ := os.OpenFile(cfg.tagFilePath(), os.O_RDWR, 0644)
 	defer file.Close()
-	reader := bufio.NewScanner(file)
-	writer := bufio.NewWriter(file)
+	original, eol, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
 
-	tagFileRe := regexp.MustCompile(`(?P<Major>\d+)\.(?P<Minor>\d+)\.(?P<Rev>\d+)-(?P<Suffix>.+)`)
 	var lines []string
+	update := &TagFileUpdate{Versions: make(TagFileVersions)}
 
 	replaced := false
-	for reader.Scan() {
-		line := reader.Text()
-		if len(line) > 0 && !strings.HasPrefix(line, "#") {
-			matches := tagFileRe.FindStringSubmatch(line)
-			paramsMap := make(map[string]string)
-			for i, name := range tagFileRe.SubexpNames() {
-				if i > 0 && i < len(matches) {
-					paramsMap[name] = matches[i]
-				}
+	section := ""
+	for _, line := range original {
+		// trimmed like processTagFile does, so that both agree on which lines are versions
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !cfg.isTagFileComment(trimmed) {
+			var label, rest string
+			label, section, rest = splitTagSection(trimmed, section)
+			if rest == "" || isTagTemplateLine(rest) {
+				lines = append(lines, line)
+				continue
 			}
-			major, err := strconv.Atoi(paramsMap["Major"])
-			minor, err := strconv.Atoi(paramsMap["Minor"])
-			rev, err := strconv.Atoi(paramsMap["Rev"])
-			semver := Semver{Major: major, Minor: minor, Rev: rev, Suffix: paramsMap["Suffix"]}
+			version, message := splitTagLine(rest)
+			semver, err := parseTagVersion(cfg, version)
 			if err != nil {
-				fail("Unable to update tagfile, tag format is not using semantic versioning")
-			}
-			var out bytes.Buffer
-			funcMap := template.FuncMap{
-				"add":
-				func(i int, what int) int {
-					return i + what
-				},
-			}
-			t1, _ := template.New("semver").Funcs(funcMap).Parse(cfg.TagFileTemplete)
-			_ = t1.Execute(&out, semver)
-			line = out.String()
+				return nil, err
+			}
+			var data interface{} = semver
+			if cfg.TagScheme == "calver" {
+				data = nextCalver(semver, now)
+			}
+			line, err = renderTemplate(cfg, "semver", cfg.TagFileTemplete, data)
+			if err != nil {
+				return nil, err
+			}
+			line = keepBuildMetadata(cfg.TagFileTemplete, line, semver.Build)
+			summary.TagVersions = append(summary.TagVersions, fmt.Sprintf("%s: %s -> %s", path, version, line))
+			if !replaced {
+				update.Old, update.New = version, line
+			}
+			if _, ok := update.Versions[section]; !ok {
+				update.Versions[section] = nil
+				if next, err := parseTagVersion(cfg, line); err == nil {
+					update.Versions[section] = &next
+				}
+			}
+			if message != "" {
+				line = fmt.Sprintf("%s|%s", line, message)
+			}
+			line = label + line
 			replaced = true
 		}
 		lines = append(lines, line)
 	}
 
 	if !replaced {
-		fail("failed")
+		if cfg.SkipEmptyTagFiles {
+			log.Warnf("No version found in tag file %s, skipping", path)
+			return nil, nil
+		}
+		return nil, errors.New(fmt.Sprintf("no version found in tag file %s", path))
 	}
 
-	_, _ = file.Seek(0, 0)
-	for _, line := range lines {
-		_, _ = writer.WriteString(line)
-		_ = writer.WriteByte(10)
+	if linesChecksum(lines) == linesChecksum(original) {
+		log.Infof("Tag file %s unchanged, skipping rewrite", path)
+		return update, nil
 	}
-	err := writer.Flush()
+	return update, writeChangedLines(cfg, file, original, lines, eol)
+}
+
+// keepBuildMetadata appends the build metadata of the old version to the rendered one when the template doesn't handle it,
+// templates written before .Build existed would otherwise drop it
+func keepBuildMetadata(template string, rendered string, build string) string {
+	if build == "" || strings.Contains(template, ".Build") || strings.Contains(rendered, "+") {
+		return rendered
+	}
+	return fmt.Sprintf("%s+%s", rendered, build)
+}
+
+func linesChecksum(lines []string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strings.Join(lines, "\n")))
+}
+
+func isTagTemplateLine(line string) bool {
+	return strings.Contains(line, "{{")
+}
+
+// ReleaseBranchContext embeds the time so that templates can keep using .Year, .AddDate, ... directly
+type ReleaseBranchContext struct {
+	time.Time
+	SHA      string
+	ShortSHA string
+	Branch   string
+}
+
+func releaseBranchName(cfg *Config, repo *git.Repository, now time.Time) (string, error) {
+	head, err := gitHead(repo)
 	if err != nil {
-		return err
+		return "", err
 	}
+	sha := head.Hash().String()
+	return renderTemplate(cfg, "mutate", cfg.ReleaseBranchTemplate, ReleaseBranchContext{
+		Time:     now,
+		SHA:      sha,
+		ShortSHA: sha[:7],
+		Branch:   head.Name().Short(),
+	})
+}
 
-	return nil
+type DivergeCommitContext struct {
+	time.Time
+	ReleaseBranch string
+	BaseBranch    string
 }
 
-func forkNewReleaseBranch(repo *git.Repository, cfg *Config) (*string, error) {
-	now := time.Now()
-	funcMap := template.FuncMap{
-		"Week":
-		func(t time.Time) int {
-			_, week := t.ISOWeek()
-			return week
-		},
-	}
-
-	var out bytes.Buffer
-	t1, _ := template.New("mutate").Funcs(funcMap).Parse(cfg.ReleaseBranchTemplate)
-	_ = t1.Execute(&out, now)
-	branchName := out.String()
-	_, _ = fmt.Fprintf(os.Stdout, "Attempting to create branch: %s", branchName)
+const defaultDivergeCommitMessage = "diverge from {{.BaseBranch}}"
+
+func divergeCommitMessage(cfg *Config, branchName string, now time.Time) (string, error) {
+	text := cfg.DivergeCommitMessage
+	if text == "" {
+		text = defaultDivergeCommitMessage
+	}
+	return renderTemplate(cfg, "divergeCommit", text, DivergeCommitContext{Time: now, ReleaseBranch: branchName, BaseBranch: cfg.BaseBranch})
+}
+
+// resolveExistingBranch applies on_branch_exists to a release branch that already exists on the remote,
+// it returns whether the release is skipped and whether the release branch has to be force pushed
+func resolveExistingBranch(repo *git.Repository, auth transport.AuthMethod, cfg *Config, branchName string, remoteBranchName string) (bool, bool, error) {
+	switch cfg.OnBranchExists {
+	case "skip":
+		log.Warnf("Release branch %s already exists on remote, skipping release", remoteBranchName)
+		return true, false, nil
+	case "reuse":
+		log.Warnf("Release branch %s already exists on remote, it will be reused", remoteBranchName)
+		return false, false, gitFetchBranch(repo, auth, remoteBranchName, branchName)
+	case "overwrite":
+		log.Warnf("Release branch %s already exists on remote, it will be overwritten", remoteBranchName)
+		return false, true, nil
+	}
+	return false, false, errors.New(fmt.Sprintf("Release branch %s already exists on remote\n", remoteBranchName))
+}
+
+// forkNewReleaseBranch returns the commit the release branch points to
+func forkNewReleaseBranch(repo *git.Repository, cfg *Config, branchName string, now time.Time, signKey *openpgp.Entity) (plumbing.Hash, error) {
+	_, _ = fmt.Fprintf(os.Stdout, "Attempting to create branch: %s\n", branchName)
 	newBranch := gitRefName(branchName)
 
 	wt, _ := repo.Worktree()
-	head, _ := repo.Head()
+	// the branch is either fetched for reuse or left behind by a previous, partially failed run in an existing clone
+	if existing, err := repo.Reference(newBranch, true); err == nil {
+		switch cfg.OnBranchExists {
+		case "reuse":
+			if err := wt.Checkout(&git.CheckoutOptions{Branch: newBranch}); err != nil {
+				return plumbing.ZeroHash, errors.New(fmt.Sprintf("unable to checkout existing release branch: %v\n", err))
+			}
+			log.Warnf("Release branch %s already exists, checked it out instead of creating it", branchName)
+			logEvent("info", "checkout", "Checked out existing branch %s at %s", branchName, existing.Hash())
+			return existing.Hash(), nil
+		case "overwrite":
+			if err := repo.Storer.RemoveReference(newBranch); err != nil {
+				return plumbing.ZeroHash, errors.New(fmt.Sprintf("unable to remove existing release branch: %v\n", err))
+			}
+			log.Warnf("Release branch %s already exists locally at %s, it will be recreated", branchName, existing.Hash())
+		default:
+			return plumbing.ZeroHash, errors.New(fmt.Sprintf("Release branch %s already exists locally\n", branchName))
+		}
+	}
+	head, err := gitHead(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	baseHash := head.Hash()
+	if cfg.BaseCommit != "" {
+		hash, err := gitResolveCommit(repo, cfg.BaseCommit)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		baseHash = hash
+	}
+	if cfg.BaseTag != "" {
+		hash, err := gitResolveTag(repo, cfg.BaseTag)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		log.Infof("Forking release branch from tag %s (%s)", cfg.BaseTag, hash)
+		baseHash = hash
+	}
 
-	err := wt.Checkout(&git.CheckoutOptions{
-		Hash:   head.Hash(),
+	err = wt.Checkout(&git.CheckoutOptions{
+		Hash:   baseHash,
 		Branch: newBranch,
 		Create: true,
 	})
 
 	if err != nil {
-		return nil, errors.New("unable to checkout release branch\n")
+		return plumbing.ZeroHash, errors.New("unable to checkout release branch\n")
 	}
+	logEvent("info", "checkout", "Checked out new branch %s at %s", branchName, baseHash)
 
-	_, err = wt.Commit("diverge from master", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "Bitrise",
-			Email: "bitrise@bitrise.io",
-			When:  now,
-		},
-	})
+	if !cfg.CreateDivergeCommit {
+		return baseHash, nil
+	}
+
+	message, err := divergeCommitMessage(cfg, branchName, now)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hash, err := gitCommit(repo, cfg.commitMessage(message), cfg.signature(now), signKey)
 
 	if err != nil {
-		return nil, errors.New("unable to create diverge commit\n")
+		return plumbing.ZeroHash, errors.New("unable to create diverge commit\n")
 	}
 
-	return &branchName, nil
+	return hash, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "--version" {
+		fmt.Println(stepVersion)
+		return
+	}
 	var cfg = &Config{}
 	if err := stepconf.Parse(cfg); err != nil {
 		fail("Error parsing config: %s\n", err)
 	}
 	stepconf.Print(cfg)
+	log.Infof("Step version: %s", stepVersion)
+	if err := tools.ExportEnvironmentWithEnvman("STEP_VERSION", stepVersion); err != nil {
+		fail("Unable to export STEP_VERSION: %v\n", err)
+	}
+	jsonLogging = cfg.LogFormat == "json"
+	networkTimeout = time.Duration(cfg.NetworkTimeoutSeconds) * time.Second
+	if err := validateConfig(cfg); err != nil {
+		fail("Invalid config: %v\n", err)
+	}
 
+	if cfg.GithubAppId != "" {
+		token, err := githubAppInstallationToken(cfg)
+		if err != nil {
+			fail("Unable to authenticate as GitHub App: %v\n", err)
+		}
+		// installation tokens are used like a personal access token, the username is ignored
+		cfg.Username = "x-access-token"
+		cfg.AccessToken = stepconf.Secret(token)
+		log.Infof("Authenticated as GitHub App %s", cfg.GithubAppId)
+	}
 	pk, err := getGitAuth(cfg)
 	if err != nil {
 		fail("%v\n", err)
 	}
-	repo, err := gitCloneMaster(cfg.CloneUrl, cfg.SourceDir, pk)
+	signKey, err := loadSignKey(string(cfg.GPGPrivateKey), string(cfg.GPGKeyPassphrase))
+	if err != nil {
+		fail("%v\n", err)
+	}
+	if cfg.ExistingClonePath != "" {
+		// every path of the step is resolved relative to the source dir, point it to the existing clone
+		cfg.SourceDir = cfg.ExistingClonePath
+	}
+	if cfg.LockSourceDir {
+		unlock, err := acquireLock(cfg.SourceDir, time.Duration(cfg.LockTimeoutSeconds)*time.Second)
+		if err != nil {
+			fail("%v", err)
+		}
+		defer unlock()
+	}
+	var repo *git.Repository
+	if cfg.ExistingClonePath != "" {
+		repo, err = gitOpenWorktree(cfg.ExistingClonePath, cfg.BaseBranch, cfg.CloneUrl, len(splitList(cfg.CommitPaths)) > 0)
+		if err != nil {
+			fail("Unable to use the existing clone: %v\n", err)
+		}
+		log.Infof("Using the existing clone at %s", cfg.ExistingClonePath)
+	} else if cfg.UseExistingClone {
+		repo, err = gitOpenWorktree(cfg.SourceDir, cfg.BaseBranch, cfg.CloneUrl, len(splitList(cfg.CommitPaths)) > 0)
+		if err != nil {
+			fail("Unable to use the existing clone: %v\n", err)
+		}
+		log.Infof("Using the existing clone at %s", cfg.SourceDir)
+	} else if cfg.CloneReferencePath != "" {
+		existing, err := dirEntryNames(cfg.SourceDir)
+		if err != nil {
+			fail("Unable to read %s: %v\n", cfg.SourceDir, err)
+		}
+		repo, err = gitCloneWithReference(cfg.CloneUrl, cfg.SourceDir, pk, cfg.BaseBranch, cfg.CloneReferencePath, cloneTagMode(cfg.CloneTags))
+		if err == git.ErrRepositoryAlreadyExists {
+			fail("%s already contains a repository, set use_existing_clone to use it: %v\n", cfg.SourceDir, err)
+		} else if err != nil {
+			log.Warnf("Unable to clone using reference %s, falling back to a regular clone: %v", cfg.CloneReferencePath, err)
+			// only remove what the failed clone created, the source dir may hold files of the build
+			if err := removeCreatedEntries(cfg.SourceDir, existing); err != nil {
+				fail("Unable to clean up %s: %v\n", cfg.SourceDir, err)
+			}
+			repo = nil
+		} else {
+			log.Infof("Cloned using reference %s", cfg.CloneReferencePath)
+		}
+	}
+	if repo == nil {
+		repo, err = gitCloneBranch(cfg.CloneUrl, cfg.SourceDir, pk, cfg.BaseBranch, cfg.CloneDepth, cloneTagMode(cfg.CloneTags), cfg.CloneRetries)
+		if err != nil {
+			fail("%v\n", err)
+		}
+	}
+	logEvent("info", "clone", "Cloned %s (%s) into %s", cfg.CloneUrl, cfg.BaseBranch, cfg.SourceDir)
+	summary.BaseBranch = cfg.BaseBranch
+	defer summary.print()
+	pushAuth := pk
+	if cfg.PushUrl != "" || cfg.PushSSHKeyPath != "" || cfg.PushAccessToken != "" {
+		pushAuth, err = getPushAuth(cfg)
+		if err != nil {
+			fail("%v\n", err)
+		}
+		if cfg.PushUrl != "" {
+			if err := gitSetRemoteUrl(repo, git.DefaultRemoteName, cfg.PushUrl); err != nil {
+				fail("Unable to set push url: %v\n", err)
+			}
+		}
+	}
+	if cfg.SkipIfNoChanges {
+		changed, err := gitHasChangesSinceLastTag(repo)
+		if err != nil {
+			fail("Unable to check for changes since the last tag: %v\n", err)
+		}
+		if !changed {
+			log.Warnf("No new commits since the last release, skipping release")
+			summary.SkipReason = "no new commits since the last release"
+			exportReleaseCreated(false)
+			return
+		}
+	}
+
+	now := time.Now()
+	branchName, err := releaseBranchName(cfg, repo, now)
+	if err != nil {
+		fail("Unable to render release branch name: %v\n", err)
+	}
+	branchName, err = sanitizeBranchName(branchName, cfg.BranchNameSanitize)
+	if err != nil {
+		fail("%v", err)
+	}
+	remoteBranchName := branchName
+	if cfg.PushReleaseAs != "" {
+		remoteBranchName, err = sanitizeBranchName(cfg.PushReleaseAs, cfg.BranchNameSanitize)
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+	forcePush := cfg.ForcePush
+	exists, err := gitRemoteBranchExists(repo, pushAuth, remoteBranchName)
 	if err != nil {
 		fail("%v\n", err)
 	}
-	_ = updateBuildNo(cfg)
-	_ = updateTagFile(cfg)
-	_ = gitAddAll(repo)
-	_ = gitCommit(repo, "[skip ci] Update version, tagfile")
+	if exists {
+		skip, overwrite, err := resolveExistingBranch(repo, pushAuth, cfg, branchName, remoteBranchName)
+		if err != nil {
+			fail("%v\n", err)
+		}
+		if skip {
+			summary.SkipReason = fmt.Sprintf("release branch %s already exists on remote", remoteBranchName)
+			exportReleaseCreated(false)
+			return
+		}
+		forcePush = forcePush || overwrite
+	}
+
+	bumpCommit := cfg.EnableVersionCode || cfg.EnableTags || cfg.GenerateChangelog
+	var newVersionCode int
+	if cfg.EnableVersionCode {
+		// highest version code of the remote tags, only used by the max_tag source
+		var tagVersionCode *int
+		if cfg.VersionCodeSource == "max_tag" {
+			remoteTags, err := gitRemoteTags(repo, git.DefaultRemoteName, pushAuth)
+			if err != nil {
+				fail("Unable to list remote tags: %v\n", err)
+			}
+			tagVersionCode = maxTagVersionCode(remoteTags, regexp.MustCompile(cfg.VersionCodeTagPattern))
+			if tagVersionCode == nil {
+				log.Warnf("No remote tag matches %s, starting from version code %d", cfg.VersionCodeTagPattern, cfg.VersionCodeTagBase)
+			} else {
+				log.Infof("Highest version code of the remote tags: %d", *tagVersionCode)
+			}
+		}
+		for i, path := range cfg.versionCodeFilePaths() {
+			update, err := updateBuildNo(cfg, path, tagVersionCode)
+			if err != nil {
+				fail("Unable to update version code file %s: %v\n", path, err)
+			}
+			log.Infof("Updated %d version code line(s) in %s: %d -> %d", update.Matches, path, update.Old, update.New)
+			if update.NewName != "" {
+				log.Infof("Updated version name in %s: %s -> %s", path, update.OldName, update.NewName)
+			}
+			logEvent("info", "bump", "Updated version code in %s: %d -> %d", path, update.Old, update.New)
+			summary.VersionCodes = append(summary.VersionCodes, fmt.Sprintf("%s: %d -> %d", path, update.Old, update.New))
+			if i == 0 {
+				newVersionCode = update.New
+			}
+		}
+		if err := tools.ExportEnvironmentWithEnvman("NEW_VERSION_CODE", strconv.Itoa(newVersionCode)); err != nil {
+			fail("Unable to export NEW_VERSION_CODE: %v\n", err)
+		}
+	}
+	bumpedVersions := make(map[string]TagFileVersions)
+	if cfg.EnableTags {
+		var firstUpdate *TagFileUpdate
+		for _, path := range cfg.tagFilePaths() {
+			update, err := updateTagFile(cfg, path, now)
+			if err != nil {
+				fail("Unable to update tag file %s: %v\n", path, err)
+			}
+			if update == nil {
+				continue
+			}
+			bumpedVersions[path] = update.Versions
+			if firstUpdate == nil {
+				firstUpdate = update
+			}
+			logEvent("info", "bump", "Updated tag file %s: %s -> %s", path, update.Old, update.New)
+		}
+		if firstUpdate != nil {
+			if err := tools.ExportEnvironmentWithEnvman("OLD_TAG_VERSION", firstUpdate.Old); err != nil {
+				fail("Unable to export OLD_TAG_VERSION: %v\n", err)
+			}
+			if err := tools.ExportEnvironmentWithEnvman("NEW_TAG_VERSION", firstUpdate.New); err != nil {
+				fail("Unable to export NEW_TAG_VERSION: %v\n", err)
+			}
+		}
+	}
+	if cfg.GenerateChangelog {
+		if err := generateChangelog(repo, cfg, branchName); err != nil {
+			fail("Unable to generate changelog: %v\n", err)
+		}
+		log.Infof("Generated changelog %s", cfg.ChangelogPath)
+	}
+	var bumpHash plumbing.Hash
+	if bumpCommit {
+		if commitPaths := splitList(cfg.CommitPaths); len(commitPaths) > 0 {
+			if err := gitAddPaths(repo, commitPaths); err != nil {
+				fail("Unable to stage changes: %v\n", err)
+			}
+		} else if err := gitAddAll(repo); err != nil {
+			fail("Unable to stage changes: %v\n", err)
+		}
+		staged, err := gitHasStagedChanges(repo)
+		if err != nil {
+			fail("Unable to read the worktree status: %v\n", err)
+		}
+		if staged {
+			bumpHash, err = gitCommit(repo, cfg.commitMessage("[skip ci] Update version, tagfile"), cfg.signature(time.Now()), signKey)
+			if err != nil {
+				fail("Unable to commit changes: %v\n", err)
+			}
+		} else {
+			log.Infof("Nothing changed, skipping the version bump commit and push")
+			bumpCommit = false
+		}
+	}
+
+	if cfg.PrePushCommand != "" {
+		if err := runPrePushCommand(cfg); err != nil {
+			fail("Pre-push command failed, nothing was pushed: %v\n", err)
+		}
+	}
+
+	if bumpCommit {
+		bumpBranch := cfg.BaseBranch
+		if cfg.BumpTargetBranch != "" && cfg.BumpTargetBranch != cfg.BaseBranch {
+			bumpBranch = cfg.BumpTargetBranch
+			if err := gitCreateBranchAtHead(repo, bumpBranch); err != nil {
+				fail("Unable to create branch %s: %v\n", bumpBranch, err)
+			}
+			log.Infof("Pushing the version bump to %s instead of %s", bumpBranch, cfg.BaseBranch)
+		}
+		if err := gitPushBranch(repo, pushAuth, cfg, bumpBranch, bumpBranch, false); err != nil {
+			fail("%v\n", err)
+		}
+		summary.BumpBranch = bumpBranch
+	}
 
-	if err := gitPushBranch(repo, pk, "master"); err != nil {
+	releaseCommit, err := forkNewReleaseBranch(repo, cfg, branchName, now, signKey)
+	if err != nil {
 		fail("%v\n", err)
 	}
+	logEvent("info", "branch", "Created release branch %s", branchName)
+	summary.ReleaseBranch = remoteBranchName
 
-	branchName, _ := forkNewReleaseBranch(repo, cfg)
-	if err := gitPushBranch(repo, pk, *branchName); err != nil {
+	var pushedRefs []plumbing.ReferenceName
+	failAndCleanup := func(format string, args ...interface{}) {
+		if cfg.CleanupOnFailure && len(pushedRefs) > 0 {
+			if err := gitDeleteRemoteRefs(repo, pushAuth, cfg, pushedRefs); err != nil {
+				log.Errorf("Cleanup failed: %v", err)
+			}
+		}
+		fail(format, args...)
+	}
+	if err := gitPushBranch(repo, pushAuth, cfg, branchName, remoteBranchName, forcePush); err != nil {
 		fail("%v\n", err)
 	}
+	if !exists {
+		pushedRefs = append(pushedRefs, gitRefName(remoteBranchName))
+	}
 
-	if err := processTagFile(repo, pk, cfg); err != nil {
-		fail("%v", err)
+	if err := tools.ExportEnvironmentWithEnvman("RELEASE_BRANCH_NAME", remoteBranchName); err != nil {
+		failAndCleanup("Unable to export RELEASE_BRANCH_NAME: %v\n", err)
+	}
+	if err := tools.ExportEnvironmentWithEnvman("RELEASE_BRANCH_COMMIT", releaseCommit.String()); err != nil {
+		failAndCleanup("Unable to export RELEASE_BRANCH_COMMIT: %v\n", err)
+	}
+
+	if cfg.CreatePullRequest {
+		if err := createGithubPullRequest(cfg, remoteBranchName); err != nil {
+			failAndCleanup("%v\n", err)
+		}
+	}
+	if cfg.CreateMergeRequest {
+		if err := createGitlabMergeRequest(cfg, remoteBranchName); err != nil {
+			failAndCleanup("%v\n", err)
+		}
+	}
+	if cfg.CreateBitbucketPullRequest {
+		if err := createBitbucketPullRequest(cfg, remoteBranchName); err != nil {
+			failAndCleanup("%v\n", err)
+		}
+	}
+
+	var pushedTags []string
+	if cfg.EnableTags {
+		if cfg.RefreshTags {
+			if err := gitFetchTags(repo, pushAuth); err != nil {
+				failAndCleanup("%v", err)
+			}
+		}
+		for _, path := range cfg.tagFilePaths() {
+			tags, err := processTagFile(repo, pushAuth, cfg, signKey, path, bumpedVersions[path])
+			for _, tag := range tags {
+				pushedRefs = append(pushedRefs, plumbing.NewTagReferenceName(tag))
+			}
+			if err != nil {
+				failAndCleanup("%v", err)
+			}
+			pushedTags = append(pushedTags, tags...)
+		}
+		if err := tools.ExportEnvironmentWithEnvman("RELEASE_TAGS", strings.Join(pushedTags, ",")); err != nil {
+			failAndCleanup("Unable to export RELEASE_TAGS: %v\n", err)
+		}
+	}
+	if cfg.DeleteReleaseBranchAfterPush {
+		if err := gitDeleteRemoteBranch(repo, pushAuth, cfg, remoteBranchName); err != nil {
+			fail("%v", err)
+		}
+	}
+	if cfg.SlackWebhookUrl != "" {
+		if err := notifySlack(cfg, remoteBranchName, pushedTags); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+	if cfg.PostReleaseWebhookUrl != "" {
+		payload := ReleasePayload{
+			Repository:    cfg.CloneUrl,
+			BaseBranch:    cfg.BaseBranch,
+			ReleaseBranch: remoteBranchName,
+			ReleaseCommit: releaseCommit.String(),
+			VersionCode:   newVersionCode,
+			TagVersions:   make(map[string]string),
+			Tags:          pushedTags,
+			Timestamp:     now,
+		}
+		if !bumpHash.IsZero() {
+			payload.BumpCommit = bumpHash.String()
+		}
+		for path, versions := range bumpedVersions {
+			for section, version := range versions {
+				if version == nil {
+					continue
+				}
+				if section != "" {
+					payload.TagVersions[fmt.Sprintf("%s [%s]", path, section)] = version.String()
+				} else {
+					payload.TagVersions[path] = version.String()
+				}
+			}
+		}
+		if err := notifyPostReleaseWebhook(cfg, payload); err != nil {
+			if cfg.WebhookRequired {
+				fail("%v", err)
+			}
+			log.Warnf("%v", err)
+		}
 	}
+	exportReleaseCreated(!cfg.DryRun)
 }
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// testConfig returns the defaults of step.yml that the file handling depends on
+func testConfig() *Config {
+	return &Config{
+		TagFileCommentPrefix: "#",
+		TagFileTemplete:      "{{.Major}}.{{add .Minor 1}}.{{.Rev}}{{with .Suffix}}-{{.}}{{end}}{{with .Build}}+{{.}}{{end}}",
+		TagScheme:            "semver",
+		BumpLevel:            "minor",
+		VersionCodeTemplate:  "{{add . increment}}",
+		VersionCodeIncrement: 1,
+		VersionCodeSource:    "file",
+		VersionCodeMatch:     "all",
+		VersionPart:          "auto",
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestUpdateTagFileSkipsIndentedCommentsAndBlankLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "TAGFILE.txt")
+	writeTestFile(t, path, "# versions\n  # indented note\n   \n1.2.3|Release 1.2.3\n")
+
+	update, err := updateTagFile(testConfig(), path, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Old != "1.2.3" || update.New != "1.3.3" {
+		t.Errorf("expected 1.2.3 -> 1.3.3, got %s -> %s", update.Old, update.New)
+	}
+	expected := "# versions\n  # indented note\n   \n1.3.3|Release 1.2.3\n"
+	if content := readTestFile(t, path); content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+// rewriteTestFile reads path with readLines, replaces its lines and writes them back with rewriteLines
+func rewriteTestFile(t *testing.T, path string, replace func(lines []string) []string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines, eol, err := readLines(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rewriteLines(file, replace(lines), eol); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRewriteLinesTruncatesLongerContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "version.txt")
+	writeTestFile(t, path, "versionCode 1\nversionName \"1.0.0-a-very-long-prerelease-name\"\n")
+
+	rewriteTestFile(t, path, func(lines []string) []string {
+		lines[1] = "versionName \"1.0.1\""
+		return lines
+	})
+
+	expected := "versionCode 1\nversionName \"1.0.1\"\n"
+	if content := readTestFile(t, path); content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+// initTestReleaseRemote creates a remote whose release/1 branch has a commit that is not on master
+func initTestReleaseRemote(t *testing.T) (string, plumbing.Hash) {
+	t.Helper()
+	dir, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: gitRefName("release/1"), Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	release := commitTestFiles(t, repo, dir, map[string]string{"hotfix.txt": "hotfix"}, "hotfix")
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: gitRefName("master")}); err != nil {
+		t.Fatal(err)
+	}
+	return dir, release
+}
+
+func TestResolveExistingBranch(t *testing.T) {
+	for _, mode := range []string{"fail", "skip", "reuse", "overwrite"} {
+		t.Run(mode, func(t *testing.T) {
+			remote, release := initTestReleaseRemote(t)
+			repo, err := gitCloneBranch(remote, t.TempDir(), nil, "master", 0, git.NoTags, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exists, err := gitRemoteBranchExists(repo, nil, "release/1")
+			if err != nil || !exists {
+				t.Fatalf("expected release/1 to exist on the remote, got %v (%v)", exists, err)
+			}
+
+			cfg := testConfig()
+			cfg.BaseBranch = "master"
+			cfg.OnBranchExists = mode
+			skip, overwrite, err := resolveExistingBranch(repo, nil, cfg, "release/1", "release/1")
+			switch mode {
+			case "fail":
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			case "skip":
+				if err != nil || !skip || overwrite {
+					t.Errorf("expected the release to be skipped, got skip=%v overwrite=%v (%v)", skip, overwrite, err)
+				}
+				return
+			}
+			if err != nil || skip || overwrite != (mode == "overwrite") {
+				t.Fatalf("unexpected skip=%v overwrite=%v (%v)", skip, overwrite, err)
+			}
+
+			releaseCommit, err := forkNewReleaseBranch(repo, cfg, "release/1", time.Now(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode == "reuse" {
+				if releaseCommit != release {
+					t.Errorf("expected the remote release branch %s to be reused, got %s", release, releaseCommit)
+				}
+				return
+			}
+			if releaseCommit == release {
+				t.Fatal("expected a new release branch from master")
+			}
+			if err := gitPushBranch(repo, nil, cfg, "release/1", "release/1", false); err == nil {
+				t.Error("expected pushing the diverged release branch without force to fail")
+			}
+			if err := gitPushBranch(repo, nil, cfg, "release/1", "release/1", overwrite); err != nil {
+				t.Fatal(err)
+			}
+			remoteRepo, err := git.PlainOpen(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := remoteRepo.Reference(gitRefName("release/1"), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Hash() != releaseCommit {
+				t.Errorf("expected the remote release branch to be overwritten with %s, got %s", releaseCommit, ref.Hash())
+			}
+		})
+	}
+}
+
+func TestForkNewReleaseBranchExistingLocalBranch(t *testing.T) {
+	for _, mode := range []string{"fail", "skip", "reuse", "overwrite"} {
+		t.Run(mode, func(t *testing.T) {
+			dir, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+			base, err := repo.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wt, err := repo.Worktree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := wt.Checkout(&git.CheckoutOptions{Branch: gitRefName("release/1"), Create: true}); err != nil {
+				t.Fatal(err)
+			}
+			stale := commitTestFiles(t, repo, dir, map[string]string{"stale.txt": "stale"}, "stale release")
+			if err := wt.Checkout(&git.CheckoutOptions{Branch: gitRefName("master")}); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := testConfig()
+			cfg.BaseBranch = "master"
+			cfg.OnBranchExists = mode
+			releaseCommit, err := forkNewReleaseBranch(repo, cfg, "release/1", time.Now(), nil)
+			switch mode {
+			case "fail", "skip":
+				if err == nil {
+					t.Error("expected an error")
+				}
+			case "reuse":
+				if err != nil || releaseCommit != stale {
+					t.Errorf("expected the local release branch %s to be reused, got %s (%v)", stale, releaseCommit, err)
+				}
+			case "overwrite":
+				if err != nil || releaseCommit != base.Hash() {
+					t.Errorf("expected the release branch to be recreated at %s, got %s (%v)", base.Hash(), releaseCommit, err)
+				}
+			}
+		})
+	}
+}
+
+func TestForkNewReleaseBranchDivergeCommit(t *testing.T) {
+	for _, diverge := range []bool{false, true} {
+		_, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+		base, err := repo.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := testConfig()
+		cfg.BaseBranch = "master"
+		cfg.AuthorName = "Release Bot"
+		cfg.AuthorEmail = "release@example.com"
+		cfg.CreateDivergeCommit = diverge
+
+		releaseCommit, err := forkNewReleaseBranch(repo, cfg, "release/1", time.Now(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := repo.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Name() != gitRefName("release/1") || head.Hash() != releaseCommit {
+			t.Errorf("expected release/1 at %s to be checked out, got %s at %s", releaseCommit, head.Name(), head.Hash())
+		}
+		if !diverge {
+			if releaseCommit != base.Hash() {
+				t.Errorf("expected the release branch to share HEAD %s with the base, got %s", base.Hash(), releaseCommit)
+			}
+			continue
+		}
+		commit, err := repo.CommitObject(releaseCommit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(commit.ParentHashes) != 1 || commit.ParentHashes[0] != base.Hash() {
+			t.Errorf("expected the diverge commit to follow %s, got %v", base.Hash(), commit.ParentHashes)
+		}
+		if commit.Message != "diverge from master" {
+			t.Errorf("unexpected diverge commit message %q", commit.Message)
+		}
+	}
+}
+
+func TestReadLinesDominantLineEnding(t *testing.T) {
+	for content, expected := range map[string]string{
+		"a\r\nb\r\nc\n": "\r\n",
+		"a\nb\nc\r\n":   "\n",
+		"a\r\nb\n":      "\r\n",
+		"a":             "\n",
+	} {
+		path := filepath.Join(t.TempDir(), "lines.txt")
+		writeTestFile(t, path, content)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, eol, err := readLines(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eol.eol != expected {
+			t.Errorf("%q: expected %q, got %q", content, expected, eol.eol)
+		}
+		for _, line := range lines {
+			if strings.HasSuffix(line, "\r") {
+				t.Errorf("%q: line %q kept its carriage return", content, line)
+			}
+		}
+	}
+}
+
+func TestRewriteLinesPreservesMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "TAGFILE.txt")
+	writeTestFile(t, path, "1.2.3\n")
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := updateTagFile(testConfig(), path, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %o", info.Mode().Perm())
+	}
+	if content := readTestFile(t, path); content != "1.3.3\n" {
+		t.Errorf("expected the tag file to be bumped, got %q", content)
+	}
+}
+
+func TestSignOffTrailer(t *testing.T) {
+	_, repo := initTestRepo(t, map[string]string{"README.md": "readme"})
+	cfg := testConfig()
+	cfg.BaseBranch = "master"
+	cfg.AuthorName = "Release Bot"
+	cfg.AuthorEmail = "release@example.com"
+	cfg.CreateDivergeCommit = true
+	cfg.SignOff = true
+
+	hash, err := forkNewReleaseBranch(repo, cfg, "release/1", time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "diverge from master\n\nSigned-off-by: Release Bot <release@example.com>"
+	if commit.Message != expected {
+		t.Errorf("expected %q, got %q", expected, commit.Message)
+	}
+	if commit.Author.Name != cfg.AuthorName || commit.Author.Email != cfg.AuthorEmail {
+		t.Errorf("expected the trailer to match the author, got %s <%s>", commit.Author.Name, commit.Author.Email)
+	}
+}
+
+func TestParseSemver(t *testing.T) {
+	for line, expected := range map[string]Semver{
+		"1.2":            {Major: 1, Minor: 2, Rev: 0, Parts: []int{1, 2, 0}},
+		"1.2.3.4":        {Major: 1, Minor: 2, Rev: 3, Parts: []int{1, 2, 3, 4}},
+		"v1.2.3-rc.1+57": {Major: 1, Minor: 2, Rev: 3, Parts: []int{1, 2, 3}, Suffix: "rc.1", Build: "57"},
+		"1.2.3.4.5-beta": {Major: 1, Minor: 2, Rev: 3, Parts: []int{1, 2, 3, 4, 5}, Suffix: "beta"},
+	} {
+		semver, err := parseSemver(line)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(semver, expected) {
+			t.Errorf("%s: expected %+v, got %+v", line, expected, semver)
+		}
+	}
+	for line, expected := range map[string]string{"1.2": "1.2.0", "1.2.3.4": "1.2.3.4"} {
+		semver, _ := parseSemver(line)
+		if semver.String() != expected {
+			t.Errorf("%s: expected %s, got %s", line, expected, semver.String())
+		}
+	}
+	for _, line := range []string{"1", "a.b.c", "1.2.3.", "99999999999999999999.0.0"} {
+		if _, err := parseSemver(line); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
+
+func TestUpdateTagFileWithoutTrailingNewline(t *testing.T) {
+	path, _ := copyFixture(t, "TAGFILE_no_newline.txt")
+
+	if _, err := updateTagFile(testConfig(), path, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# release versions\n1.3.3|Release 1.2.3"
+	if content := readTestFile(t, path); content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+func TestUpdateTagFileKeepsBuildMetadataWithOldTemplate(t *testing.T) {
+	for template, expected := range map[string]string{
+		"{{.Major}}.{{add .Minor 1}}.{{.Rev}}-{{.Suffix}}":                                              "1.3.3-rc.1+build.45\n",
+		"{{.Major}}.{{add .Minor 1}}.{{.Rev}}{{with .Suffix}}-{{.}}{{end}}{{with .Build}}+{{.}}{{end}}": "1.3.3-rc.1+build.45\n",
+		"{{.Major}}.{{add .Minor 1}}.{{.Rev}}{{with .Suffix}}-{{.}}{{end}}{{with .Build}}+ci{{end}}":    "1.3.3-rc.1+ci\n",
+	} {
+		path := filepath.Join(t.TempDir(), "TAGFILE.txt")
+		writeTestFile(t, path, "1.2.3-rc.1+build.45\n")
+		cfg := testConfig()
+		cfg.TagFileTemplete = template
+
+		if _, err := updateTagFile(cfg, path, time.Now()); err != nil {
+			t.Fatalf("%s: %v", template, err)
+		}
+		if content := readTestFile(t, path); content != expected {
+			t.Errorf("%s: expected %q, got %q", template, expected, content)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+type NetrcEntry struct {
+	Login    string
+	Password string
+}
+
+// parseNetrc reads the machine entries of a netrc file, the "default" entry is stored under the empty host
+func parseNetrc(content string) map[string]NetrcEntry {
+	entries := map[string]NetrcEntry{}
+	var current *NetrcEntry
+	var host string
+	store := func() {
+		if current != nil {
+			if _, ok := entries[host]; !ok {
+				entries[host] = *current
+			}
+		}
+	}
+
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+			switch fields[j] {
+			case "machine":
+				store()
+				host = next()
+				current = &NetrcEntry{}
+			case "default":
+				store()
+				host = ""
+				current = &NetrcEntry{}
+			case "login":
+				if current != nil {
+					current.Login = next()
+				} else {
+					next()
+				}
+			case "password":
+				if current != nil {
+					current.Password = next()
+				} else {
+					next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				// macro definitions run until the next empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	store()
+	return entries
+}
+
+// netrcCredentials returns the netrc entry matching the host of the remote, or the default entry when there is none
+func netrcCredentials(path string, remoteUrl string) (*NetrcEntry, error) {
+	u, err := url.Parse(remoteUrl)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read netrc file: %v\n", err))
+	}
+	entries := parseNetrc(string(content))
+	if entry, ok := entries[u.Hostname()]; ok {
+		return &entry, nil
+	}
+	if entry, ok := entries[""]; ok {
+		return &entry, nil
+	}
+	return nil, nil
+}
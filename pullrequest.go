@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type PullRequestContext struct {
+	ReleaseBranch string
+	BaseBranch    string
+}
+
+func repoHostAndPath(cloneUrl string) (string, string, error) {
+	u, err := url.Parse(cloneUrl)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "https" {
+		return "", "", errors.New(fmt.Sprintf("not an https remote: %s", cloneUrl))
+	}
+	return u.Host, strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git"), nil
+}
+
+func postJSON(url string, header http.Header, payload interface{}, result interface{}) (int, error) {
+	return postJSONWithTimeout(url, header, payload, result, 30*time.Second)
+}
+
+func postJSONWithTimeout(url string, header http.Header, payload interface{}, result interface{}, timeout time.Duration) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		_ = json.NewDecoder(resp.Body).Decode(result)
+	}
+	return resp.StatusCode, nil
+}
+
+func githubApiUrl(host string) (string, bool) {
+	if host == "github.com" {
+		return "https://api.github.com", true
+	}
+	if strings.Contains(host, "github") {
+		// GitHub Enterprise serves the REST API under /api/v3 of the instance
+		return fmt.Sprintf("https://%s/api/v3", host), true
+	}
+	return "", false
+}
+
+func createGithubPullRequest(cfg *Config, releaseBranch string) error {
+	host, repoPath, err := repoHostAndPath(cfg.CloneUrl)
+	if err != nil {
+		log.Warnf("Skipping pull request creation: %v", err)
+		return nil
+	}
+	apiUrl, ok := githubApiUrl(host)
+	if !ok {
+		log.Warnf("Skipping pull request creation: %s is not a GitHub host", host)
+		return nil
+	}
+
+	base := cfg.PullRequestBase
+	if base == "" {
+		base = cfg.BaseBranch
+	}
+	title, err := renderTemplate(cfg, "prTitle", cfg.PullRequestTitleTemplate, PullRequestContext{ReleaseBranch: releaseBranch, BaseBranch: base})
+	if err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		log.Warnf("Dry run: skipping pull request %s -> %s: %s", releaseBranch, base, title)
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("token %s", cfg.AccessToken))
+	header.Set("Accept", "application/vnd.github.v3+json")
+	var result struct {
+		HtmlUrl string `json:"html_url"`
+		Message string `json:"message"`
+	}
+	status, err := postJSON(fmt.Sprintf("%s/repos/%s/pulls", apiUrl, repoPath), header, map[string]string{
+		"title": title,
+		"head":  releaseBranch,
+		"base":  base,
+	}, &result)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create pull request: %v\n", err))
+	}
+	if status != http.StatusCreated {
+		return errors.New(fmt.Sprintf("unable to create pull request, GitHub responded with %d: %s\n", status, result.Message))
+	}
+	log.Donef("Created pull request: %s", result.HtmlUrl)
+	return nil
+}
+
+func createGitlabMergeRequest(cfg *Config, releaseBranch string) error {
+	host, repoPath, err := repoHostAndPath(cfg.CloneUrl)
+	if err != nil {
+		log.Warnf("Skipping merge request creation: %v", err)
+		return nil
+	}
+	if !strings.Contains(host, "gitlab") {
+		log.Warnf("Skipping merge request creation: %s is not a GitLab host", host)
+		return nil
+	}
+
+	target := cfg.MergeRequestTargetBranch
+	if target == "" {
+		target = cfg.BaseBranch
+	}
+	title, err := renderTemplate(cfg, "mrTitle", cfg.MergeRequestTitleTemplate, PullRequestContext{ReleaseBranch: releaseBranch, BaseBranch: target})
+	if err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		log.Warnf("Dry run: skipping merge request %s -> %s: %s", releaseBranch, target, title)
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("PRIVATE-TOKEN", string(cfg.AccessToken))
+	var result struct {
+		WebUrl  string      `json:"web_url"`
+		Message interface{} `json:"message"`
+	}
+	status, err := postJSON(fmt.Sprintf("https://%s/api/v4/projects/%s/merge_requests", host, url.PathEscape(repoPath)), header, map[string]string{
+		"title":         title,
+		"source_branch": releaseBranch,
+		"target_branch": target,
+	}, &result)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create merge request: %v\n", err))
+	}
+	if status != http.StatusCreated {
+		return errors.New(fmt.Sprintf("unable to create merge request, GitLab responded with %d: %v\n", status, result.Message))
+	}
+	log.Donef("Created merge request: %s", result.WebUrl)
+	return nil
+}
+
+func createBitbucketPullRequest(cfg *Config, releaseBranch string) error {
+	host, repoPath, err := repoHostAndPath(cfg.CloneUrl)
+	if err != nil {
+		log.Warnf("Skipping Bitbucket pull request creation: %v", err)
+		return nil
+	}
+	if host != "bitbucket.org" {
+		log.Warnf("Skipping Bitbucket pull request creation: %s is not a Bitbucket Cloud host", host)
+		return nil
+	}
+
+	destination := cfg.BitbucketPullRequestDestination
+	if destination == "" {
+		destination = cfg.BaseBranch
+	}
+	title, err := renderTemplate(cfg, "bitbucketPrTitle", cfg.BitbucketPullRequestTitleTemplate, PullRequestContext{ReleaseBranch: releaseBranch, BaseBranch: destination})
+	if err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		log.Warnf("Dry run: skipping Bitbucket pull request %s -> %s: %s", releaseBranch, destination, title)
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+string(cfg.AccessToken))))
+	var result struct {
+		Links struct {
+			Html struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	status, err := postJSON(fmt.Sprintf("https://api.bitbucket.org/2.0/repositories/%s/pullrequests", repoPath), header, map[string]interface{}{
+		"title":       title,
+		"source":      map[string]interface{}{"branch": map[string]string{"name": releaseBranch}},
+		"destination": map[string]interface{}{"branch": map[string]string{"name": destination}},
+	}, &result)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create Bitbucket pull request: %v\n", err))
+	}
+	if status != http.StatusCreated {
+		return errors.New(fmt.Sprintf("unable to create Bitbucket pull request, Bitbucket responded with %d: %s\n", status, result.Error.Message))
+	}
+	log.Donef("Created Bitbucket pull request: %s", result.Links.Html.Href)
+	return nil
+}
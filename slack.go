@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+	"strings"
+)
+
+func slackReleaseMessage(branchName string, tags []string) string {
+	lines := []string{fmt.Sprintf("Release branch *%s* created", branchName)}
+	for _, versionCode := range summary.VersionCodes {
+		lines = append(lines, fmt.Sprintf("Version code: %s", versionCode))
+	}
+	for _, tagVersion := range summary.TagVersions {
+		lines = append(lines, fmt.Sprintf("Version: %s", tagVersion))
+	}
+	if len(tags) > 0 {
+		lines = append(lines, fmt.Sprintf("Tags: %s", strings.Join(tags, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func notifySlack(cfg *Config, branchName string, tags []string) error {
+	text := slackReleaseMessage(branchName, tags)
+	if cfg.DryRun {
+		log.Warnf("Dry run: skipping Slack notification:\n%s", text)
+		return nil
+	}
+
+	status, err := postJSON(string(cfg.SlackWebhookUrl), http.Header{}, map[string]string{
+		"text": text,
+	}, nil)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to send Slack notification: %v\n", err))
+	}
+	if status != http.StatusOK {
+		return errors.New(fmt.Sprintf("unable to send Slack notification, Slack responded with %d\n", status))
+	}
+	return nil
+}
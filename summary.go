@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/bitrise-io/go-utils/log"
+)
+
+type TagResult struct {
+	Name   string
+	Result string
+}
+
+type RunSummary struct {
+	BaseBranch    string
+	BumpBranch    string
+	ReleaseBranch string
+	SkipReason    string
+	VersionCodes  []string
+	TagVersions   []string
+	Tags          []TagResult
+}
+
+var summary RunSummary
+
+func (s *RunSummary) addTag(name string, result string) {
+	s.Tags = append(s.Tags, TagResult{Name: name, Result: result})
+}
+
+func (s *RunSummary) print() {
+	log.Infof("Summary")
+	log.Printf("Base branch: %s", s.BaseBranch)
+	if s.SkipReason != "" {
+		log.Printf("Release skipped: %s", s.SkipReason)
+		return
+	}
+	if s.BumpBranch != "" && s.BumpBranch != s.BaseBranch {
+		log.Printf("Version bump pushed to: %s", s.BumpBranch)
+	}
+	for _, versionCode := range s.VersionCodes {
+		log.Printf("Version code: %s", versionCode)
+	}
+	for _, tagVersion := range s.TagVersions {
+		log.Printf("Tag version: %s", tagVersion)
+	}
+	log.Printf("Release branch: %s", s.ReleaseBranch)
+	if len(s.Tags) == 0 {
+		log.Printf("Tags: none")
+	}
+	for _, tag := range s.Tags {
+		log.Printf("Tag %s: %s", tag.Name, tag.Result)
+	}
+}
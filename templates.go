@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+func templateFuncMap(cfg *Config) template.FuncMap {
+	return template.FuncMap{
+		"add": func(i int, what int) int {
+			return i + what
+		},
+		"sub": func(i int, what int) int {
+			return i - what
+		},
+		"increment": func() int {
+			return cfg.VersionCodeIncrement
+		},
+		"Week": func(value interface{}) (int, error) {
+			t, err := templateTime(value)
+			return week(t, cfg.WeekStart), err
+		},
+		"ISOWeek": func(value interface{}) (int, error) {
+			t, err := templateTime(value)
+			_, week := t.ISOWeek()
+			return week, err
+		},
+		"ISOWeekYear": func(value interface{}) (int, error) {
+			t, err := templateTime(value)
+			year, _ := t.ISOWeek()
+			return year, err
+		},
+		"Year": func(value interface{}) (int, error) {
+			t, err := templateTime(value)
+			return t.Year(), err
+		},
+		"bump": func(semver Semver, level ...string) (Semver, error) {
+			if len(level) == 0 {
+				return semver.Bump(cfg.BumpLevel), nil
+			}
+			switch level[0] {
+			case "major", "minor", "patch":
+				return semver.Bump(level[0]), nil
+			}
+			return semver, errors.New(fmt.Sprintf("unknown bump level: %s", level[0]))
+		},
+		"bumpPart": func(semver Semver, index int) (Semver, error) {
+			return semver.BumpPart(index)
+		},
+		"bumpPrerelease": func(semver Semver) (Semver, error) {
+			return semver.BumpPrerelease()
+		},
+	}
+}
+
+// week numbers the weeks of the year of t. The ISO week belongs to the year of its thursday, so the first days of
+// January can be in week 52/53 and the last days of December in week 1. With sunday or monday as the first day of
+// the week, week 1 is the week of January 1st and the numbering always restarts with the calendar year.
+func week(t time.Time, start string) int {
+	var firstDay time.Weekday
+	switch start {
+	case "sunday":
+		firstDay = time.Sunday
+	case "monday":
+		firstDay = time.Monday
+	default:
+		_, week := t.ISOWeek()
+		return week
+	}
+	jan1 := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	offset := (int(jan1.Weekday()) - int(firstDay) + 7) % 7
+	return (t.YearDay()-1+offset)/7 + 1
+}
+
+// templateTime accepts a time.Time or a template context embedding one (ReleaseBranchContext, CalverContext),
+// so that templates written when the context was the plain time keep working, e.g. {{Week .}}
+func templateTime(value interface{}) (time.Time, error) {
+	if t, ok := value.(time.Time); ok {
+		return t, nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		timeType := reflect.TypeOf(time.Time{})
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.Anonymous && field.Type == timeType {
+				return v.Field(i).Interface().(time.Time), nil
+			}
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("expected a time, got %T", value))
+}
+
+func parseTemplate(cfg *Config, name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncMap(cfg)).Parse(text)
+}
+
+func renderTemplate(cfg *Config, name string, text string, data interface{}) (string, error) {
+	t1, err := parseTemplate(cfg, name, text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t1.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
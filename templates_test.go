@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReleaseBranchTemplateFuncsAcceptContext(t *testing.T) {
+	cfg := &Config{WeekStart: "iso"}
+	ctx := ReleaseBranchContext{
+		Time:     time.Date(2021, time.March, 4, 10, 0, 0, 0, time.UTC),
+		SHA:      "0123456789abcdef0123456789abcdef01234567",
+		ShortSHA: "0123456",
+		Branch:   "master",
+	}
+	for template, expected := range map[string]string{
+		"release/{{.Year}}w{{Week .}}":                                                          "release/2021w9",
+		"release/{{Year .}}w{{ISOWeek .}}-{{ISOWeekYear .}}":                                    "release/2021w9-2021",
+		"{{with $newdate := .AddDate 0 0 7}}release/{{$newdate.Year}}w{{Week $newdate}}{{end}}": "release/2021w10",
+		"release/{{.Branch}}-{{.ShortSHA}}":                                                     "release/master-0123456",
+	} {
+		name, err := renderTemplate(cfg, "mutate", template, ctx)
+		if err != nil {
+			t.Errorf("%s: %v", template, err)
+			continue
+		}
+		if name != expected {
+			t.Errorf("%s: expected %s, got %s", template, expected, name)
+		}
+	}
+
+	if _, err := renderTemplate(cfg, "mutate", "{{Week .SHA}}", ctx); err == nil {
+		t.Error("expected Week of a string to fail")
+	}
+}
+
+func TestWeekAroundNewYear(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		date  time.Time
+		weeks map[string]int
+	}{
+		// thursday, the ISO week belongs to 2020
+		{date(2020, time.December, 31), map[string]int{"iso": 53, "monday": 53, "sunday": 53}},
+		{date(2021, time.January, 1), map[string]int{"iso": 53, "monday": 1, "sunday": 1}},
+		// monday, the ISO week belongs to 2019
+		{date(2018, time.December, 31), map[string]int{"iso": 1, "monday": 53, "sunday": 53}},
+		{date(2019, time.January, 1), map[string]int{"iso": 1, "monday": 1, "sunday": 1}},
+		// sunday
+		{date(2017, time.December, 31), map[string]int{"iso": 52, "monday": 53, "sunday": 53}},
+		{date(2018, time.January, 1), map[string]int{"iso": 1, "monday": 1, "sunday": 1}},
+	} {
+		for start, expected := range test.weeks {
+			if got := week(test.date, start); got != expected {
+				t.Errorf("%s with %s: expected week %d, got %d", test.date.Format("2006-01-02"), start, expected, got)
+			}
+		}
+	}
+}
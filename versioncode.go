@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type VersionCodeUpdate struct {
+	Old     int
+	New     int
+	Matches int
+	OldName string
+	NewName string
+}
+
+var plistVersionRe = regexp.MustCompile(`<string>\s*(\d+)\s*</string>`)
+var pubspecVersionRe = regexp.MustCompile(`^version:\s*["']?\d+\.\d+\.(?P<Patch>\d+)(?:-[0-9A-Za-z.-]+)?(?:\+(?P<Build>\d+))?`)
+var versionNameRe = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+var packageJsonVersionRe = regexp.MustCompile(`^\d+\.\d+\.(?P<Patch>\d+)(?:-[0-9A-Za-z.-]+)?(?:\+(?P<Build>\d+))?$`)
+
+// updateBuildNo bumps the version code of the file, tagVersionCode is the highest version code of the remote tags
+// when version_code_source is max_tag
+func updateBuildNo(cfg *Config, path string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return VersionCodeUpdate{}, errors.New(fmt.Sprintf("unable to open version code file %s: %v", path, err))
+	}
+	defer file.Close()
+	lines, eol, err := readLines(file)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	original := append([]string(nil), lines...)
+
+	var update VersionCodeUpdate
+	switch cfg.VersionCodeFormat {
+	case "plist":
+		update, err = updatePlistVersionCode(cfg, lines, tagVersionCode)
+	case "pubspec":
+		update, err = updatePubspecVersionCode(cfg, lines, tagVersionCode)
+	case "package_json":
+		update, err = updatePackageJsonVersionCode(cfg, lines, tagVersionCode)
+	case "xml":
+		update, err = updateXmlVersionCode(cfg, lines, tagVersionCode)
+	case "properties":
+		update, err = updatePropertiesVersionCode(cfg, lines, tagVersionCode)
+	case "toml":
+		update, err = updateTomlVersionCode(cfg, lines, tagVersionCode)
+	default:
+		update, err = updateRegexVersionCode(cfg, lines, tagVersionCode)
+	}
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	if cfg.VersionNameRegex != "" {
+		update.OldName, update.NewName, err = updateVersionName(cfg, lines)
+		if err != nil {
+			return VersionCodeUpdate{}, err
+		}
+	}
+
+	if err := writeChangedLines(cfg, file, original, lines, eol); err != nil {
+		return VersionCodeUpdate{}, err
+	}
+
+	return update, nil
+}
+
+func updateRegexVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	buildVersionRe, err := regexp.Compile(cfg.VersionCodeRegex)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+
+	var update VersionCodeUpdate
+	for i, line := range lines {
+		if buildVersionRe.MatchString(line) {
+			verCodeRe := regexp.MustCompile(`\d+`)
+			match := verCodeRe.FindString(line)
+			verCode, err := strconv.Atoi(match)
+			if err != nil {
+				return VersionCodeUpdate{}, errors.New(fmt.Sprintf("unable to parse version code on line %d: %s", i+1, strings.TrimSpace(line)))
+			}
+
+			verCodeNew, err := bumpVersionCode(cfg, verCode, tagVersionCode)
+			if err != nil {
+				return VersionCodeUpdate{}, err
+			}
+			lines[i] = strings.Replace(line, match, strconv.Itoa(verCodeNew), 1)
+			update.record(verCode, verCodeNew)
+			if cfg.VersionCodeMatch == "first" {
+				break
+			}
+		}
+	}
+
+	if update.Matches == 0 {
+		return VersionCodeUpdate{}, errors.New(fmt.Sprintf("no line matches version code regex: %s", cfg.VersionCodeRegex))
+	}
+	return update, nil
+}
+
+func updateVersionName(cfg *Config, lines []string) (string, string, error) {
+	nameRe, err := regexp.Compile(cfg.VersionNameRegex)
+	if err != nil {
+		return "", "", err
+	}
+	for i, line := range lines {
+		if !nameRe.MatchString(line) {
+			continue
+		}
+		matches := versionNameRe.FindStringSubmatchIndex(line)
+		if matches == nil {
+			return "", "", errors.New(fmt.Sprintf("version name is not a semantic version on line %d: %s", i+1, strings.TrimSpace(line)))
+		}
+		var parts [3]int
+		for j := range parts {
+			part, err := strconv.Atoi(line[matches[2*j+2]:matches[2*j+3]])
+			if err != nil {
+				return "", "", errors.New(fmt.Sprintf("unable to parse version name on line %d: %s: %v", i+1, strings.TrimSpace(line), err))
+			}
+			parts[j] = part
+		}
+		oldName := line[matches[0]:matches[1]]
+		newName, err := renderTemplate(cfg, "verName", cfg.VersionNameTemplate, Semver{Major: parts[0], Minor: parts[1], Rev: parts[2]})
+		if err != nil {
+			return "", "", err
+		}
+		lines[i] = line[:matches[0]] + newName + line[matches[1]:]
+		return oldName, newName, nil
+	}
+	return "", "", errors.New(fmt.Sprintf("no line matches version name regex: %s", cfg.VersionNameRegex))
+}
+
+func updatePlistVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	var update VersionCodeUpdate
+	for i := 0; i < len(lines)-1; i++ {
+		if !strings.Contains(lines[i], "<key>CFBundleVersion</key>") {
+			continue
+		}
+		line := lines[i+1]
+		matches := plistVersionRe.FindStringSubmatchIndex(line)
+		if matches == nil {
+			return VersionCodeUpdate{}, errors.New(fmt.Sprintf("CFBundleVersion is not a numeric <string> value: %s", strings.TrimSpace(line)))
+		}
+		verCode, _ := strconv.Atoi(line[matches[2]:matches[3]])
+		verCodeNew, err := bumpVersionCode(cfg, verCode, tagVersionCode)
+		if err != nil {
+			return VersionCodeUpdate{}, err
+		}
+		lines[i+1] = line[:matches[2]] + strconv.Itoa(verCodeNew) + line[matches[3]:]
+		update.record(verCode, verCodeNew)
+	}
+
+	if update.Matches == 0 {
+		return VersionCodeUpdate{}, errors.New("no CFBundleVersion key found")
+	}
+	return update, nil
+}
+
+func updatePropertiesVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	propertyRe := regexp.MustCompile(fmt.Sprintf(`^(\s*%s\s*[=:]\s*)(\d+)(\s*)$`, regexp.QuoteMeta(cfg.VersionCodeKey)))
+
+	var update VersionCodeUpdate
+	for i, line := range lines {
+		matches := propertyRe.FindStringSubmatchIndex(line)
+		if matches == nil {
+			continue
+		}
+		verCode, _ := strconv.Atoi(line[matches[4]:matches[5]])
+		verCodeNew, err := bumpVersionCode(cfg, verCode, tagVersionCode)
+		if err != nil {
+			return VersionCodeUpdate{}, err
+		}
+		lines[i] = line[:matches[4]] + strconv.Itoa(verCodeNew) + line[matches[5]:]
+		update.record(verCode, verCodeNew)
+		if cfg.VersionCodeMatch == "first" {
+			break
+		}
+	}
+
+	if update.Matches == 0 {
+		return VersionCodeUpdate{}, errors.New(fmt.Sprintf("no numeric %s property found", cfg.VersionCodeKey))
+	}
+	return update, nil
+}
+
+func updatePubspecVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	var update VersionCodeUpdate
+	for i, line := range lines {
+		if !pubspecVersionRe.MatchString(line) {
+			continue
+		}
+		newLine, err := bumpVersionPart(cfg, line, pubspecVersionRe, &update, tagVersionCode)
+		if err != nil {
+			return VersionCodeUpdate{}, err
+		}
+		lines[i] = newLine
+		break
+	}
+
+	if update.Matches == 0 {
+		return VersionCodeUpdate{}, errors.New("no top level version key found")
+	}
+	return update, nil
+}
+
+func updatePackageJsonVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	content := strings.Join(lines, "\n")
+	start, end, err := findTopLevelJsonString(content, "version")
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	var version string
+	if err := json.Unmarshal([]byte(content[start:end]), &version); err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	if !packageJsonVersionRe.MatchString(version) {
+		return VersionCodeUpdate{}, errors.New(fmt.Sprintf("version is not a semantic version: %s", version))
+	}
+
+	var update VersionCodeUpdate
+	newVersion, err := bumpVersionPart(cfg, version, packageJsonVersionRe, &update, tagVersionCode)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	content = content[:start] + strconv.Quote(newVersion) + content[end:]
+	copy(lines, strings.Split(content, "\n"))
+	return update, nil
+}
+
+func updateTomlVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	index, start, end, err := findTomlString(lines, cfg.VersionCodeTomlKey)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	line := lines[index]
+	version := line[start:end]
+	if !packageJsonVersionRe.MatchString(version) {
+		return VersionCodeUpdate{}, errors.New(fmt.Sprintf("%s is not a semantic version: %s", cfg.VersionCodeTomlKey, version))
+	}
+
+	var update VersionCodeUpdate
+	newVersion, err := bumpVersionPart(cfg, version, packageJsonVersionRe, &update, tagVersionCode)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	lines[index] = line[:start] + newVersion + line[end:]
+	return update, nil
+}
+
+var tomlTableRe = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?\s*(?:#.*)?$`)
+var tomlKeyValueRe = regexp.MustCompile(`^\s*([A-Za-z0-9_\-."' ]+?)\s*=\s*"([^"\\]*)"`)
+var tomlAnyValueRe = regexp.MustCompile(`^\s*[A-Za-z0-9_\-."' ]+?\s*=(.*)$`)
+
+// tomlArrayDepth returns how many arrays are left open by value, brackets in strings and comments are ignored
+func tomlArrayDepth(value string) int {
+	depth := 0
+	var quote rune
+	escaped := false
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return depth
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+// findTomlString returns the line and the range of the basic string value at the dotted path,
+// only the value is replaced so comments, tables and key order are preserved
+func findTomlString(lines []string, path string) (int, int, int, error) {
+	table := ""
+	inMultiline := false
+	arrayDepth := 0
+	for i, line := range lines {
+		if strings.Count(line, `"""`)%2 == 1 || strings.Count(line, `'''`)%2 == 1 {
+			inMultiline = !inMultiline
+			continue
+		}
+		if inMultiline {
+			continue
+		}
+		// the elements of an array spanning several lines can look like table headers
+		if arrayDepth > 0 {
+			arrayDepth += tomlArrayDepth(line)
+			continue
+		}
+		if matches := tomlAnyValueRe.FindStringSubmatch(line); matches != nil {
+			arrayDepth = tomlArrayDepth(matches[1])
+		}
+		if matches := tomlTableRe.FindStringSubmatch(line); matches != nil {
+			table = normalizeTomlKey(matches[1])
+			continue
+		}
+		matches := tomlKeyValueRe.FindStringSubmatchIndex(line)
+		if matches == nil {
+			continue
+		}
+		key := normalizeTomlKey(line[matches[2]:matches[3]])
+		if table != "" {
+			key = table + "." + key
+		}
+		if key == path {
+			return i, matches[4], matches[5], nil
+		}
+	}
+	return 0, 0, 0, errors.New(fmt.Sprintf("no string value found for %s", path))
+}
+
+func normalizeTomlKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// findTopLevelJsonString returns the byte range of the quoted string value of key in the top level object,
+// the rest of the document is left untouched so that formatting is preserved when it is replaced
+func findTopLevelJsonString(content string, key string) (int, int, error) {
+	dec := json.NewDecoder(strings.NewReader(content))
+	depth := 0
+	expectKey := false
+	currentKey := ""
+	for {
+		before := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			depth--
+			continue
+		}
+		if depth == 1 {
+			if expectKey {
+				currentKey, _ = tok.(string)
+				expectKey = false
+			} else {
+				if _, ok := tok.(string); ok && currentKey == key {
+					end := int(dec.InputOffset())
+					return int(before) + strings.Index(content[before:end], "\""), end, nil
+				}
+				expectKey = true
+			}
+		}
+		if delim, ok := tok.(json.Delim); ok && (delim == '{' || delim == '[') {
+			depth++
+			if depth == 1 {
+				expectKey = delim == '{'
+			}
+		}
+	}
+	return 0, 0, errors.New(fmt.Sprintf("no top level %s string found", key))
+}
+
+var xmlSelectorRe = regexp.MustCompile(`^(?P<Element>[\w.:-]+)(?:\[(?P<FilterAttr>[\w.:-]+)=(?P<FilterValue>[^\]]*)\])?(?:@(?P<Attr>[\w.:-]+))?$`)
+
+type XmlSelector struct {
+	Selector    string
+	Element     string
+	FilterAttr  string
+	FilterValue string
+	Attr        string
+}
+
+// parseXmlSelector parses selectors like `integer[name=build]` (element text) or `manifest@android:versionCode` (attribute),
+// namespace prefixes are ignored when matching
+func parseXmlSelector(selector string) (XmlSelector, error) {
+	matches := xmlSelectorRe.FindStringSubmatch(selector)
+	if matches == nil {
+		return XmlSelector{}, errors.New(fmt.Sprintf("invalid xml selector: %s", selector))
+	}
+	return XmlSelector{Selector: selector, Element: matches[1], FilterAttr: matches[2], FilterValue: matches[3], Attr: matches[4]}, nil
+}
+
+func xmlLocalName(name string) string {
+	return name[strings.LastIndex(name, ":")+1:]
+}
+
+func (selector XmlSelector) matches(element xml.StartElement) bool {
+	if element.Name.Local != xmlLocalName(selector.Element) {
+		return false
+	}
+	if selector.FilterAttr == "" {
+		return true
+	}
+	for _, attr := range element.Attr {
+		if attr.Name.Local == xmlLocalName(selector.FilterAttr) && attr.Value == selector.FilterValue {
+			return true
+		}
+	}
+	return false
+}
+
+// findXmlVersionCode returns the byte range of the number selected in content, the document is not re-encoded
+// so that the formatting of the other nodes is preserved
+func findXmlVersionCode(content string, selector XmlSelector) (int, int, error) {
+	dec := xml.NewDecoder(strings.NewReader(content))
+	for {
+		before := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		element, ok := tok.(xml.StartElement)
+		if !ok || !selector.matches(element) {
+			continue
+		}
+		after := int(dec.InputOffset())
+
+		if selector.Attr != "" {
+			attrRe := regexp.MustCompile(`(?:^|[\s:])` + regexp.QuoteMeta(xmlLocalName(selector.Attr)) + `\s*=\s*["']\s*(\d+)`)
+			matches := attrRe.FindStringSubmatchIndex(content[before:after])
+			if matches == nil {
+				return 0, 0, errors.New(fmt.Sprintf("attribute %s of <%s> is not a number", selector.Attr, selector.Element))
+			}
+			return before + matches[2], before + matches[3], nil
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return 0, 0, err
+		}
+		if _, ok := tok.(xml.CharData); !ok {
+			return 0, 0, errors.New(fmt.Sprintf("<%s> has no text content", selector.Element))
+		}
+		matches := regexp.MustCompile(`^\s*(\d+)\s*$`).FindStringSubmatchIndex(content[after:dec.InputOffset()])
+		if matches == nil {
+			return 0, 0, errors.New(fmt.Sprintf("text of <%s> is not a number", selector.Element))
+		}
+		return after + matches[2], after + matches[3], nil
+	}
+	return 0, 0, errors.New(fmt.Sprintf("no element matches xml selector %s", selector.Selector))
+}
+
+func updateXmlVersionCode(cfg *Config, lines []string, tagVersionCode *int) (VersionCodeUpdate, error) {
+	selector, err := parseXmlSelector(cfg.VersionCodeXmlSelector)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	content := strings.Join(lines, "\n")
+	start, end, err := findXmlVersionCode(content, selector)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+
+	var update VersionCodeUpdate
+	verCode, _ := strconv.Atoi(content[start:end])
+	verCodeNew, err := bumpVersionCode(cfg, verCode, tagVersionCode)
+	if err != nil {
+		return VersionCodeUpdate{}, err
+	}
+	update.record(verCode, verCodeNew)
+	content = content[:start] + strconv.Itoa(verCodeNew) + content[end:]
+	copy(lines, strings.Split(content, "\n"))
+	return update, nil
+}
+
+// versionPart resolves version_part auto: Flutter versions carry the version code as build number,
+// package.json and Cargo.toml versions rarely have one so their patch component is bumped
+func (cfg *Config) versionPart() string {
+	if cfg.VersionPart != "auto" {
+		return cfg.VersionPart
+	}
+	if cfg.VersionCodeFormat == "pubspec" {
+		return "build"
+	}
+	return "patch"
+}
+
+func bumpVersionPart(cfg *Config, text string, re *regexp.Regexp, update *VersionCodeUpdate, tagVersionCode *int) (string, error) {
+	group := re.SubexpIndex("Build")
+	if cfg.versionPart() == "patch" {
+		group = re.SubexpIndex("Patch")
+	}
+	matches := re.FindStringSubmatchIndex(text)
+	start, end := matches[2*group], matches[2*group+1]
+	if start < 0 {
+		return "", errors.New(fmt.Sprintf("version has no build number: %s, set version_part to patch to bump the patch component", text))
+	}
+	verCode, _ := strconv.Atoi(text[start:end])
+	verCodeNew, err := bumpVersionCode(cfg, verCode, tagVersionCode)
+	if err != nil {
+		return "", err
+	}
+	update.record(verCode, verCodeNew)
+	return text[:start] + strconv.Itoa(verCodeNew) + text[end:], nil
+}
+
+// googlePlayMaxVersionCode is the largest versionCode accepted by Google Play
+const googlePlayMaxVersionCode = 2100000000
+
+func bumpVersionCode(cfg *Config, verCode int, tagVersionCode *int) (int, error) {
+	verCodeNew, err := nextVersionCode(cfg, verCode, tagVersionCode)
+	if err != nil {
+		return 0, err
+	}
+	if max := cfg.versionCodeMax(); max > 0 && verCodeNew > max {
+		return 0, errors.New(fmt.Sprintf("new version code %d exceeds the maximum version code %d, see version_code_max", verCodeNew, max))
+	}
+	return verCodeNew, nil
+}
+
+// versionCodeMax defaults to the Google Play limit when any of the version code files belongs to an Android project
+func (cfg *Config) versionCodeMax() int {
+	if cfg.VersionCodeMax > 0 {
+		return cfg.VersionCodeMax
+	}
+	for _, path := range cfg.versionCodeFilePaths() {
+		name := filepath.Base(path)
+		if strings.HasSuffix(name, ".gradle") || strings.HasSuffix(name, ".gradle.kts") || name == "gradle.properties" || name == "AndroidManifest.xml" {
+			return googlePlayMaxVersionCode
+		}
+	}
+	return 0
+}
+
+// maxTagVersionCode takes the version code from the first group of pattern, or from the first number of the tag
+func maxTagVersionCode(tags map[string]bool, pattern *regexp.Regexp) *int {
+	var max *int
+	for tag := range tags {
+		matches := pattern.FindStringSubmatch(tag)
+		if matches == nil {
+			continue
+		}
+		number := regexp.MustCompile(`\d+`).FindString(tag)
+		if len(matches) > 1 {
+			number = matches[1]
+		}
+		verCode, err := strconv.Atoi(number)
+		if err != nil {
+			continue
+		}
+		if max == nil || verCode > *max {
+			max = &verCode
+		}
+	}
+	return max
+}
+
+// nextVersionCode renders the version code template, for the max_tag source with the highest version code of the remote tags
+// instead of the one of the file, a nil tagVersionCode means that no tag matched and the tag base is used
+func nextVersionCode(cfg *Config, verCode int, tagVersionCode *int) (int, error) {
+	switch cfg.VersionCodeSource {
+	case "bitrise_build_number":
+		return cfg.VersionCodeOffset + cfg.BuildNumber, nil
+	case "max_tag":
+		if tagVersionCode == nil {
+			return cfg.VersionCodeTagBase, nil
+		}
+		verCode = *tagVersionCode
+	}
+	out, err := renderTemplate(cfg, "verCode", cfg.VersionCodeTemplate, verCode)
+	if err != nil {
+		return 0, err
+	}
+	verCodeNew, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("version code template produced a non-numeric value: %s", out))
+	}
+	return verCodeNew, nil
+}
+
+func (update *VersionCodeUpdate) record(old int, new int) {
+	if update.Matches == 0 {
+		update.Old = old
+		update.New = new
+	}
+	update.Matches++
+}
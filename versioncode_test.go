@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNextVersionCodeTemplates(t *testing.T) {
+	for _, template := range []string{"{{add . 1}}", "{{add . increment}}"} {
+		cfg := &Config{VersionCodeSource: "file", VersionCodeTemplate: template, VersionCodeIncrement: 1}
+		verCode, err := nextVersionCode(cfg, 41, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", template, err)
+		}
+		if verCode != 42 {
+			t.Errorf("%s: expected 42, got %d", template, verCode)
+		}
+	}
+
+	cfg := &Config{VersionCodeSource: "file", VersionCodeTemplate: "{{add . increment}}", VersionCodeIncrement: 10}
+	if verCode, err := nextVersionCode(cfg, 41, nil); err != nil || verCode != 51 {
+		t.Errorf("expected 51, got %d (%v)", verCode, err)
+	}
+
+	cfg = &Config{VersionCodeSource: "max_tag", VersionCodeTemplate: "{{add . increment}}", VersionCodeIncrement: 1, VersionCodeTagBase: 100}
+	if verCode, err := nextVersionCode(cfg, 41, nil); err != nil || verCode != 100 {
+		t.Errorf("expected the tag base 100 without a matching tag, got %d (%v)", verCode, err)
+	}
+	tagVersionCode := 63
+	if verCode, err := nextVersionCode(cfg, 41, &tagVersionCode); err != nil || verCode != 64 {
+		t.Errorf("expected 64, got %d (%v)", verCode, err)
+	}
+}
+
+// copyFixture copies a file of testdata into a temporary directory so that it can be rewritten
+func copyFixture(t *testing.T, name string) (string, string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	writeTestFile(t, path, string(content))
+	return path, string(content)
+}
+
+// assertFixtureChange checks that updating the fixture only replaced old with new
+func assertFixtureChange(t *testing.T, path string, original string, old string, new string) {
+	t.Helper()
+	if strings.Count(original, old) != 1 {
+		t.Fatalf("%s has to occur exactly once in the fixture", old)
+	}
+	expected := strings.Replace(original, old, new, 1)
+	if content := readTestFile(t, path); content != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+}
+
+func TestUpdatePubspecVersionCode(t *testing.T) {
+	for part, expected := range map[string]string{"build": "version: 1.4.2+58", "patch": "version: 1.4.3+57"} {
+		path, original := copyFixture(t, "pubspec.yaml")
+		cfg := testConfig()
+		cfg.VersionCodeFormat = "pubspec"
+		cfg.VersionPart = part
+
+		update, err := updateBuildNo(cfg, path, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", part, err)
+		}
+		if update.Matches != 1 {
+			t.Errorf("%s: expected a single match, got %d", part, update.Matches)
+		}
+		assertFixtureChange(t, path, original, "version: 1.4.2+57", expected)
+	}
+}
+
+func TestUpdateRegexVersionCodeMatch(t *testing.T) {
+	for match, wear := range map[string]string{"first": "versionCode 2120", "all": "versionCode 2121"} {
+		path, original := copyFixture(t, "build.gradle")
+		cfg := testConfig()
+		cfg.VersionCodeRegex = `^\s*versionCode\s+\d+`
+		cfg.VersionCodeMatch = match
+
+		update, err := updateBuildNo(cfg, path, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", match, err)
+		}
+		if update.Old != 120 || update.New != 121 {
+			t.Errorf("%s: expected the first match to be reported, got %d -> %d", match, update.Old, update.New)
+		}
+		if matches := map[string]int{"first": 1, "all": 2}[match]; update.Matches != matches {
+			t.Errorf("%s: expected %d matches, got %d", match, matches, update.Matches)
+		}
+		expected := strings.Replace(strings.Replace(original, "versionCode 120", "versionCode 121", 1), "versionCode 2120", wear, 1)
+		if content := readTestFile(t, path); content != expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", match, expected, content)
+		}
+	}
+}
+
+func TestUpdatePackageJsonVersionCode(t *testing.T) {
+	for part, expected := range map[string]string{"auto": `"version": "1.4.3"`, "patch": `"version": "1.4.3"`} {
+		path, original := copyFixture(t, "package.json")
+		cfg := testConfig()
+		cfg.VersionCodeFormat = "package_json"
+		cfg.VersionPart = part
+
+		update, err := updateBuildNo(cfg, path, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", part, err)
+		}
+		if update.Old != 2 || update.New != 3 {
+			t.Errorf("%s: expected 2 -> 3, got %d -> %d", part, update.Old, update.New)
+		}
+		assertFixtureChange(t, path, original, `"version": "1.4.2"`, expected)
+	}
+
+	path, _ := copyFixture(t, "package.json")
+	cfg := testConfig()
+	cfg.VersionCodeFormat = "package_json"
+	cfg.VersionPart = "build"
+	if _, err := updateBuildNo(cfg, path, nil); err == nil || !strings.Contains(err.Error(), "version_part") {
+		t.Errorf("expected a version without build number to point to version_part, got %v", err)
+	}
+}
+
+func TestFindTopLevelJsonString(t *testing.T) {
+	for content, expected := range map[string]string{
+		`{"a": {"version": "1"}, "version": "2"}`:          `"2"`,
+		`{"a": [{"version": "1"}, []], "version" : "3.0"}`: `"3.0"`,
+		`{"version": "4", "b": {"version": "5"}}`:          `"4"`,
+	} {
+		start, end, err := findTopLevelJsonString(content, "version")
+		if err != nil {
+			t.Errorf("%s: %v", content, err)
+			continue
+		}
+		if content[start:end] != expected {
+			t.Errorf("%s: expected %s, got %s", content, expected, content[start:end])
+		}
+	}
+	for _, content := range []string{`{"a": {"version": "1"}}`, `{"version": 1}`, `["version", "1"]`} {
+		if _, _, err := findTopLevelJsonString(content, "version"); err == nil {
+			t.Errorf("%s: expected no top level version string", content)
+		}
+	}
+}
+
+func TestUpdateBuildNoKeepsCrlf(t *testing.T) {
+	path, _ := copyFixture(t, "version_crlf.properties")
+	cfg := testConfig()
+	cfg.VersionCodeRegex = "^VERSION_CODE="
+
+	if _, err := updateBuildNo(cfg, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := "VERSION_NAME=1.4.2\r\nVERSION_CODE=58\r\n# mostly CRLF, this line is not\r\nBUILD_TYPE=release\r\n"
+	if content := readTestFile(t, path); content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+func TestUpdatePropertiesVersionCode(t *testing.T) {
+	for key, change := range map[string][2]string{
+		"VERSION_CODE":      {"VERSION_CODE = 57", "VERSION_CODE = 58"},
+		"VERSION_CODE_WEAR": {"VERSION_CODE_WEAR=2057", "VERSION_CODE_WEAR=2058"},
+		"BUILD_NUMBER":      {"BUILD_NUMBER: 310", "BUILD_NUMBER: 311"},
+	} {
+		path, original := copyFixture(t, "gradle.properties")
+		cfg := testConfig()
+		cfg.VersionCodeFormat = "properties"
+		cfg.VersionCodeKey = key
+
+		update, err := updateBuildNo(cfg, path, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if update.Matches != 1 {
+			t.Errorf("%s: expected a single match, got %d", key, update.Matches)
+		}
+		assertFixtureChange(t, path, original, change[0], change[1])
+	}
+
+	path, _ := copyFixture(t, "gradle.properties")
+	cfg := testConfig()
+	cfg.VersionCodeFormat = "properties"
+	cfg.VersionCodeKey = "VERSION_NAME"
+	if _, err := updateBuildNo(cfg, path, nil); err == nil {
+		t.Error("expected a non-numeric property to fail")
+	}
+}
+
+func TestUpdateTomlVersionCode(t *testing.T) {
+	for key, change := range map[string][2]string{
+		"package.version":                 {`version = "1.4.2" # bumped`, `version = "1.4.3" # bumped`},
+		"package.metadata.bundle.version": {`version = "8.8.8"`, `version = "8.8.9"`},
+	} {
+		path, original := copyFixture(t, "Cargo.toml")
+		cfg := testConfig()
+		cfg.VersionCodeFormat = "toml"
+		cfg.VersionCodeTomlKey = key
+
+		if _, err := updateBuildNo(cfg, path, nil); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		assertFixtureChange(t, path, original, change[0], change[1])
+	}
+}
+
+func TestFindTomlString(t *testing.T) {
+	_, original := copyFixture(t, "Cargo.toml")
+	lines := strings.Split(original, "\n")
+	for key, expected := range map[string]string{
+		"package.name":     "release-app",
+		"dependencies.log": "0.4",
+		"bin.path":         "src/main.rs",
+		"package.edition":  "2021",
+	} {
+		index, start, end, err := findTomlString(lines, key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if value := lines[index][start:end]; value != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, value)
+		}
+	}
+	// inline tables, literal strings and keys of a multiline string are not basic string values
+	for _, key := range []string{"dependencies.serde.version", "package.license", "version", "nested.edition"} {
+		if _, _, _, err := findTomlString(lines, key); err == nil {
+			t.Errorf("%s: expected no string value", key)
+		}
+	}
+}
+
+func TestUpdateVersionNameRejectsInvalidComponent(t *testing.T) {
+	cfg := testConfig()
+	cfg.VersionNameRegex = `versionName`
+	cfg.VersionNameTemplate = "{{.Major}}.{{add .Minor 1}}.{{.Rev}}"
+	lines := []string{`        versionName "1.99999999999999999999.0"`}
+
+	if _, _, err := updateVersionName(cfg, lines); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected an error pointing at line 1, got %v", err)
+	}
+	if lines[0] != `        versionName "1.99999999999999999999.0"` {
+		t.Errorf("expected the line to be left untouched, got %s", lines[0])
+	}
+
+	lines = []string{`        versionName "1.4.2"`}
+	if oldName, newName, err := updateVersionName(cfg, lines); err != nil || oldName != "1.4.2" || newName != "1.5.2" {
+		t.Errorf("expected 1.4.2 -> 1.5.2, got %s -> %s (%v)", oldName, newName, err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+	"time"
+)
+
+const postReleaseWebhookTimeout = 10 * time.Second
+
+type ReleasePayload struct {
+	Repository    string            `json:"repository"`
+	BaseBranch    string            `json:"base_branch"`
+	ReleaseBranch string            `json:"release_branch"`
+	ReleaseCommit string            `json:"release_commit"`
+	BumpCommit    string            `json:"bump_commit,omitempty"`
+	VersionCode   int               `json:"version_code,omitempty"`
+	TagVersions   map[string]string `json:"tag_versions,omitempty"`
+	Tags          []string          `json:"tags"`
+	Timestamp     time.Time         `json:"timestamp"`
+}
+
+func notifyPostReleaseWebhook(cfg *Config, payload ReleasePayload) error {
+	if cfg.DryRun {
+		log.Warnf("Dry run: skipping post release webhook")
+		return nil
+	}
+
+	status, err := postJSONWithTimeout(string(cfg.PostReleaseWebhookUrl), http.Header{}, payload, nil, postReleaseWebhookTimeout)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to call post release webhook: %v\n", err))
+	}
+	if status < 200 || status > 299 {
+		return errors.New(fmt.Sprintf("post release webhook responded with %d\n", status))
+	}
+	log.Donef("Called post release webhook")
+	return nil
+}